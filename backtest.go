@@ -0,0 +1,100 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/alexeyvy/tjlike-agenda/infra/backtest"
+	"github.com/alexeyvy/tjlike-agenda/infra/snapshot"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+// runBacktest replays recorded snapshots through the configured selection and prints what would have been reposted.
+// Given another config to compare against, prints how its reposts differ instead
+func runBacktest(args []string) {
+	flags := flag.NewFlagSet("backtest", flag.ExitOnError)
+	configPath := flags.String("config", "config.yaml", "config of the selection to replay")
+	againstPath := flags.String("against", "", "config of the candidate selection to compare with")
+	snapshotsPath := flags.String("snapshots", "", "snapshot file to replay, snapshots.path of the config by default")
+	_ = flags.Parse(args)
+
+	baseline := loadPreferences(*configPath)
+	path := *snapshotsPath
+	if path == "" {
+		path = baseline.Snapshots.Path
+	}
+	if path == "" {
+		log.Fatalf("no snapshot file to replay, set snapshots.path in the config or pass -snapshots")
+	}
+	// retention of the running application is relative to the current moment, history is replayed in full
+	snapshots := snapshot.NewFileStore(path, snapshot.Retention{})
+	if err := snapshots.Pull(); err != nil {
+		log.Fatalf("cannot load view snapshots: %v", err)
+	}
+
+	baselineReposts := replay(baseline, snapshots)
+	if *againstPath == "" {
+		printReposts(os.Stdout, baselineReposts)
+		return
+	}
+	candidateReposts := replay(loadPreferences(*againstPath), snapshots)
+	printDiff(os.Stdout, backtest.Compare(baselineReposts, candidateReposts))
+}
+
+func replay(preferences preferences, source backtest.Source) []backtest.Repost {
+	traversals := backtest.Traversals(source, preferences.Scrapers.Telegram.channels())
+	history := backtest.NewHistory(preferences.Selection.Stories.toStoryRules())
+	clock := &backtest.Clock{}
+	selector := preferences.globalSelector(history, clock.Now)
+	log.Infof("Replaying %d traversals", len(traversals))
+	return backtest.Run(traversals, selector, history, clock)
+}
+
+func printRepost(w io.Writer, prefix string, repost backtest.Repost) {
+	_, _ = fmt.Fprintf(
+		w,
+		"%s%s\t%s\t%s\t%.2f\t%s %.2f\n",
+		prefix,
+		repost.At.Format(time.RFC3339),
+		repost.Selection.Publication.Id,
+		repost.Selection.Channel.Id,
+		repost.Selection.Rate,
+		repost.Selection.Explanation.Selector,
+		repost.Selection.Explanation.LocalRate,
+	)
+}
+
+func printReposts(out io.Writer, reposts []backtest.Repost) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "REPOSTED AT\tPUBLICATION\tCHANNEL\tRATE\tLOCAL RATE")
+	for _, repost := range reposts {
+		printRepost(w, "", repost)
+	}
+	_ = w.Flush()
+}
+
+func printDiff(out io.Writer, diff backtest.Diff) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintf(
+		w,
+		"%d reposted by both at the same moment, %d moved, %d only by baseline (-), %d only by candidate (+)\n",
+		diff.Same,
+		len(diff.Moved),
+		len(diff.OnlyBaseline),
+		len(diff.OnlyCandidate),
+	)
+	for _, repost := range diff.OnlyBaseline {
+		printRepost(w, "- ", repost)
+	}
+	for _, repost := range diff.OnlyCandidate {
+		printRepost(w, "+ ", repost)
+	}
+	for _, change := range diff.Moved {
+		printRepost(w, "< ", change.Baseline)
+		printRepost(w, "> ", change.Candidate)
+	}
+	_ = w.Flush()
+}
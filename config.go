@@ -0,0 +1,538 @@
+package main
+
+import (
+	"fmt"
+	domain "github.com/alexeyvy/tjlike-agenda/domain"
+	"github.com/alexeyvy/tjlike-agenda/infra/repost"
+	"github.com/alexeyvy/tjlike-agenda/infra/scraping"
+	"github.com/alexeyvy/tjlike-agenda/infra/snapshot"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"time"
+)
+
+type ScraperConfigEntry struct {
+	Parallel                 bool
+	Workers                  int
+	RateLimit                RateLimitConfigEntry `yaml:"rate_limit"`
+	Rotation                 RotationConfigEntry
+	Frequency                int
+	PauseBetweenSyncChannels int    `yaml:"pause_between_sync_channels"`
+	BaseURL                  string `yaml:"base_url"`
+	Timeout                  int
+	Retry                    RetryConfigEntry
+	Depth                    DepthConfigEntry
+	Channels                 []ChannelConfigEntry
+}
+type RateLimitConfigEntry struct {
+	RequestsPerSecond float64 `yaml:"requests_per_second"`
+	Burst             int
+}
+
+type RotationConfigEntry struct {
+	Mode        string
+	Proxies     []string
+	UserAgents  []string `yaml:"user_agents"`
+	MaxFailures int      `yaml:"max_failures"`
+	Cooldown    int
+}
+
+func (r RotationConfigEntry) toRotationPolicy() scraping.RotationPolicy {
+	return scraping.RotationPolicy{
+		Mode:        r.Mode,
+		Proxies:     r.Proxies,
+		UserAgents:  r.UserAgents,
+		MaxFailures: r.MaxFailures,
+		Cooldown:    time.Second * time.Duration(r.Cooldown),
+	}
+}
+
+// httpClient rotates proxies and User-Agent strings
+func (c ScraperConfigEntry) httpClient() *http.Client {
+	rotatingTransport, err := scraping.NewRotatingTransport(nil, c.Rotation.toRotationPolicy())
+	if err != nil {
+		log.Fatalf("invalid rotation config: %v", err)
+	}
+	return &http.Client{
+		Timeout:   time.Second * time.Duration(c.Timeout),
+		Transport: rotatingTransport,
+	}
+}
+
+// rateLimiter is shared by all channels of the scraper, nil if there is no limit
+func (c ScraperConfigEntry) rateLimiter() *scraping.RateLimiter {
+	return scraping.NewRateLimiter(c.RateLimit.RequestsPerSecond, c.RateLimit.Burst)
+}
+
+type RetryConfigEntry struct {
+	MaxAttempts    int `yaml:"max_attempts"`
+	InitialBackoff int `yaml:"initial_backoff"`
+	MaxBackoff     int `yaml:"max_backoff"`
+}
+
+func (r RetryConfigEntry) toRetryPolicy() scraping.RetryPolicy {
+	return scraping.RetryPolicy{
+		MaxAttempts:    r.MaxAttempts,
+		InitialBackoff: time.Second * time.Duration(r.InitialBackoff),
+		MaxBackoff:     time.Second * time.Duration(r.MaxBackoff),
+	}
+}
+
+type DepthConfigEntry struct {
+	Publications int
+	MaxAge       int `yaml:"max_age"`
+}
+
+func (d DepthConfigEntry) isSet() bool {
+	return d.Publications != 0 || d.MaxAge != 0
+}
+func (d DepthConfigEntry) toDepth() scraping.Depth {
+	return scraping.Depth{Publications: d.Publications, MaxAge: time.Second * time.Duration(d.MaxAge)}
+}
+
+// ChannelConfigEntry is either a plain channel ID or a mapping with ID and per-channel overrides
+type ChannelConfigEntry struct {
+	Id       string
+	Depth    DepthConfigEntry
+	Priority int
+	Weight   *float64
+	MinRate  float64 `yaml:"min_rate"`
+	// overrides of the selection section, applied on top of it
+	Selection yaml.Node
+}
+
+func (c ChannelConfigEntry) toChannel() domain.Channel {
+	channel := domain.NewChannel(c.Id)
+	channel.Priority = c.Priority
+	if c.Weight != nil {
+		channel.Weight = *c.Weight
+	}
+	channel.MinRate = domain.SuggestionRate(c.MinRate)
+	return channel
+}
+
+func (c *ChannelConfigEntry) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		c.Id = value.Value
+		return nil
+	}
+	type plain ChannelConfigEntry
+	return value.Decode((*plain)(c))
+}
+
+// depthFor resolves channel depth, falling back to the scraper-wide one
+func (c ScraperConfigEntry) depthFor(channel ChannelConfigEntry) scraping.Depth {
+	if channel.Depth.isSet() {
+		return channel.Depth.toDepth()
+	}
+	return c.Depth.toDepth()
+}
+
+type ApiConfigEntry struct {
+	// GET /reposts acknowledges what it returns, as it did before POST /reposts/ack
+	AckOnRead bool `yaml:"ack_on_read"`
+	// registered on start, others are registered with POST /consumers. Unregistered consumers are rejected by the API
+	Consumers []string
+}
+
+// where the file engine keeps reposts unless told otherwise
+const defaultFileStorePath = "tjlike_agenda_db.txt"
+
+type StorageConfigEntry struct {
+	Engine    string
+	Path      string
+	Retention RetentionConfigEntry
+}
+
+type RetentionConfigEntry struct {
+	// periodicity of purging (seconds)
+	Schedule int
+	// reposts made earlier are stale (seconds), 0 means no limit
+	MaxAge int `yaml:"max_age"`
+	// reposts beyond the latest ones are stale, 0 means no limit
+	MaxCount    int    `yaml:"max_count"`
+	KeepForever bool   `yaml:"keep_forever"`
+	StaleUnread string `yaml:"stale_unread"`
+}
+
+func defaultRetentionConfigEntry() RetentionConfigEntry {
+	retention := repost.DefaultRetention()
+	return RetentionConfigEntry{
+		Schedule:    3600,
+		MaxAge:      int(retention.MaxAge / time.Second),
+		StaleUnread: string(retention.StaleUnread),
+	}
+}
+
+func (r RetentionConfigEntry) schedule() time.Duration {
+	if r.Schedule <= 0 {
+		log.Fatalf("retention schedule must be positive, got %d", r.Schedule)
+	}
+	return time.Second * time.Duration(r.Schedule)
+}
+
+func (r RetentionConfigEntry) toRetention() repost.Retention {
+	policy := repost.StaleUnreadPolicy(r.StaleUnread)
+	switch policy {
+	case repost.StaleUnreadPurge, repost.StaleUnreadKeep, repost.StaleUnreadDeadLetter:
+	default:
+		log.Fatalf("unknown stale unread policy %s", r.StaleUnread)
+	}
+	if r.MaxAge < 0 || r.MaxCount < 0 {
+		log.Fatalf("retention max_age and max_count must not be negative")
+	}
+	return repost.Retention{
+		MaxAge:      time.Second * time.Duration(r.MaxAge),
+		MaxCount:    r.MaxCount,
+		KeepForever: r.KeepForever,
+		StaleUnread: policy,
+	}
+}
+
+func (s StorageConfigEntry) initStore() repost.Store {
+	switch s.Engine {
+	case "", "file":
+		path := s.Path
+		if path == "" {
+			path = defaultFileStorePath
+		}
+		return repost.NewFileStore(path)
+	case "bolt":
+		path := s.Path
+		if path == "" {
+			path = "tjlike_agenda.db"
+		}
+		store, err := repost.NewBoltStore(path)
+		if err != nil {
+			log.Fatalf("cannot open repost storage: %v", err)
+		}
+		// installs switching from the file engine keep what they had
+		imported, err := store.ImportFileStore(repost.NewFileStore(defaultFileStorePath))
+		if err != nil {
+			// a broken JSON DB is exactly what switching to bolt gets away from, so it's put aside rather than fatal
+			asidePath := defaultFileStorePath + ".broken"
+			log.Errorf("cannot import %s into repost storage, starting empty and moving it to %s: %v", defaultFileStorePath, asidePath, err)
+			if err := os.Rename(defaultFileStorePath, asidePath); err != nil {
+				log.Errorf("cannot move %s aside: %v", defaultFileStorePath, err)
+			}
+		}
+		if imported {
+			log.Infof("Imported reposts of %s into %s, the former is no longer used", defaultFileStorePath, path)
+		}
+		return store
+	}
+	log.Fatalf("unknown storage engine %s", s.Engine)
+	return nil
+}
+
+type SnapshotsConfigEntry struct {
+	Path       string
+	Retention  int
+	MaxSamples int `yaml:"max_samples"`
+}
+
+// channels are the configured channels by ID
+func (c ScraperConfigEntry) channels() map[string]domain.Channel {
+	channels := make(map[string]domain.Channel, len(c.Channels))
+	for _, entry := range c.Channels {
+		channels[entry.Id] = entry.toChannel()
+	}
+	return channels
+}
+
+func (s SnapshotsConfigEntry) initStore() *snapshot.Store {
+	retention := snapshot.Retention{
+		MaxAge:     time.Second * time.Duration(s.Retention),
+		MaxSamples: s.MaxSamples,
+	}
+	if s.Path == "" {
+		return snapshot.NewInMemoryStore(retention)
+	}
+	store := snapshot.NewFileStore(s.Path, retention)
+	if err := store.Pull(); err != nil && err != snapshot.ErrNotInited {
+		log.Fatalf("cannot load view snapshots: %v", err)
+	}
+	return store
+}
+
+type SelectionConfigEntry struct {
+	SelectorConfigEntry `yaml:",inline"`
+	Limit               SelectionLimitConfigEntry
+	Diversity           DiversityConfigEntry
+	Stories             StoriesConfigEntry
+	Rules               []RuleConfigEntry
+}
+
+// SelectorConfigEntry is what can be overridden per channel
+type SelectorConfigEntry struct {
+	Local     string
+	Threshold float64
+	Simple    SimpleConfigEntry
+	Velocity  VelocityConfigEntry
+	MAD       MADConfigEntry `yaml:"mad"`
+}
+type SimpleConfigEntry struct {
+	Weights []float64
+}
+type VelocityConfigEntry struct {
+	MinAge    int `yaml:"min_age"`
+	MinSample int `yaml:"min_sample"`
+}
+type MADConfigEntry struct {
+	Window           int
+	MinSample        int     `yaml:"min_sample"`
+	MinRelativeScale float64 `yaml:"min_relative_scale"`
+}
+
+func defaultSelectorConfigEntry() SelectorConfigEntry {
+	simple := domain.DefaultSimpleParams()
+	velocity := domain.DefaultVelocityParams()
+	mad := domain.DefaultMADParams()
+	return SelectorConfigEntry{
+		Local:     "simple",
+		Threshold: domain.DefaultSuggestionRateThreshold,
+		Simple:    SimpleConfigEntry{simple.Weights},
+		Velocity:  VelocityConfigEntry{int(velocity.MinAge / time.Second), velocity.MinSample},
+		MAD:       MADConfigEntry{mad.Window, mad.MinSample, mad.MinRelativeScale},
+	}
+}
+
+// overriddenBy applies the channel's overrides on top of the selector config
+func (s SelectorConfigEntry) overriddenBy(channelId string, override yaml.Node) SelectorConfigEntry {
+	s.Simple.Weights = append([]float64(nil), s.Simple.Weights...)
+	if override.Kind == 0 {
+		return s
+	}
+	if err := override.Decode(&s); err != nil {
+		log.Fatalf("invalid selection override of channel %s: %v", channelId, err)
+	}
+	return s
+}
+
+// localSelector tells the section in the config, e.g. "selection", should it be invalid
+func (s SelectorConfigEntry) localSelector(section string, clock func() time.Time) domain.LocalSelector {
+	if s.Threshold < 0 {
+		log.Fatalf("invalid %s: threshold can't be negative, got %f", section, s.Threshold)
+	}
+	var (
+		localSelector domain.LocalSelector
+		err           error
+	)
+	switch s.Local {
+	case "", "simple":
+		params := domain.SimpleParams{Weights: s.Simple.Weights}
+		localSelector, err = domain.NewSimpleLocalSelector(params), params.Validate()
+	case "velocity":
+		params := domain.VelocityParams{
+			MinAge:    time.Second * time.Duration(s.Velocity.MinAge),
+			MinSample: s.Velocity.MinSample,
+		}
+		localSelector, err = domain.NewVelocityLocalSelector(params, clock), params.Validate()
+	case "mad":
+		params := domain.MADParams{
+			Window:           s.MAD.Window,
+			MinSample:        s.MAD.MinSample,
+			MinRelativeScale: s.MAD.MinRelativeScale,
+		}
+		localSelector, err = domain.NewMADLocalSelector(params), params.Validate()
+	default:
+		err = fmt.Errorf("unknown local selector %s", s.Local)
+	}
+	if err != nil {
+		log.Fatalf("invalid %s: %v", section, err)
+	}
+	return localSelector
+}
+
+// fields describe parameters of the chosen local selector only, so that the selection can be reproduced
+func (s SelectorConfigEntry) fields() log.Fields {
+	fields := log.Fields{"local": s.Local, "threshold": s.Threshold}
+	switch s.Local {
+	case "", "simple":
+		fields["weights"] = s.Simple.Weights
+	case "velocity":
+		fields["min_age"] = s.Velocity.MinAge
+		fields["min_sample"] = s.Velocity.MinSample
+	case "mad":
+		fields["window"] = s.MAD.Window
+		fields["min_sample"] = s.MAD.MinSample
+		fields["min_relative_scale"] = s.MAD.MinRelativeScale
+	}
+	return fields
+}
+
+type DiversityConfigEntry struct {
+	MaxPerWindow  int `yaml:"max_per_window"`
+	Window        int
+	MinGap        int     `yaml:"min_gap"`
+	PenaltyFactor float64 `yaml:"penalty_factor"`
+	PenaltyWindow int     `yaml:"penalty_window"`
+}
+
+func (d DiversityConfigEntry) toDiversityRules() domain.DiversityRules {
+	return domain.DiversityRules{
+		MaxPerWindow:  d.MaxPerWindow,
+		Window:        time.Second * time.Duration(d.Window),
+		MinGap:        time.Second * time.Duration(d.MinGap),
+		PenaltyFactor: d.PenaltyFactor,
+		PenaltyWindow: time.Second * time.Duration(d.PenaltyWindow),
+	}
+}
+
+type StoriesConfigEntry struct {
+	Similarity     float64
+	Representative string
+}
+
+func (s StoriesConfigEntry) toStoryRules() domain.StoryRules {
+	if s.Similarity < 0 || s.Similarity > 1 {
+		log.Fatalf("story similarity must be between 0 and 1, got %f", s.Similarity)
+	}
+	representative := domain.StoryRepresentative(s.Representative)
+	switch representative {
+	case "":
+		representative = domain.StoryRepresentativeEarliest
+	case domain.StoryRepresentativeEarliest, domain.StoryRepresentativeMostViewed:
+	default:
+		log.Fatalf("unknown story representative %s", s.Representative)
+	}
+	return domain.StoryRules{
+		Similarity:     s.Similarity,
+		Representative: representative,
+	}
+}
+
+type RuleConfigEntry struct {
+	Name     string
+	Channels []string
+	Keywords []string
+	Hashtags []string
+	Links    []string
+	Pattern  string
+	Action   string
+	Factor   float64
+}
+
+func (r RuleConfigEntry) toRule() domain.Rule {
+	rule := domain.Rule{
+		Name:     r.Name,
+		Channels: r.Channels,
+		Keywords: r.Keywords,
+		Hashtags: r.Hashtags,
+		Links:    r.Links,
+		Action:   domain.RuleAction(r.Action),
+		Factor:   r.Factor,
+	}
+	if r.Pattern != "" {
+		pattern, err := regexp.Compile(r.Pattern)
+		if err != nil {
+			log.Fatalf("invalid pattern of selection rule %s: %v", r.Name, err)
+		}
+		rule.Pattern = pattern
+	}
+	if err := rule.Validate(); err != nil {
+		log.Fatalf("invalid selection rule: %v", err)
+	}
+	return rule
+}
+
+func (s SelectionConfigEntry) rules() domain.Rules {
+	rules := make(domain.Rules, len(s.Rules))
+	for k, entry := range s.Rules {
+		rule := entry.toRule()
+		rules[k] = rule
+		log.WithFields(log.Fields{"action": rule.Action, "channels": rule.Channels}).Infof("Selection rule %s", rule.Name)
+	}
+	return rules
+}
+
+type SelectionLimitConfigEntry struct {
+	Mode       string
+	N          int
+	Threshold  float64
+	Deviations float64
+}
+
+func (l SelectionLimitConfigEntry) toSelectionLimit() domain.SelectionLimit {
+	switch l.Mode {
+	case "", domain.SelectionModeTop, domain.SelectionModeThreshold, domain.SelectionModeDynamic:
+	default:
+		log.Fatalf("unknown selection limit mode %s", l.Mode)
+	}
+	return domain.SelectionLimit{
+		Mode:       l.Mode,
+		N:          l.N,
+		Threshold:  domain.SuggestionRate(l.Threshold),
+		Deviations: l.Deviations,
+	}
+}
+
+// globalSelector builds the selector out of the selection config along with per-channel overrides,
+// selectors tell the current moment by the clock
+func (p preferences) globalSelector(history domain.RepostHistory, clock func() time.Time) *domain.SimpleGlobalSelector {
+	localSelector := p.Selection.localSelector("selection", clock)
+	log.WithFields(p.Selection.fields()).Info("Selection parameters")
+
+	globalSelector := domain.NewGlobalSelector(localSelector)
+	globalSelector.Threshold = domain.SuggestionRate(p.Selection.Threshold)
+	globalSelector.Limit = p.Selection.Limit.toSelectionLimit()
+	globalSelector.Diversity = p.Selection.Diversity.toDiversityRules()
+	globalSelector.Stories = p.Selection.Stories.toStoryRules()
+	globalSelector.Rules = p.Selection.rules()
+	globalSelector.History = history
+	globalSelector.Clock = clock
+	globalSelector.Channels = make(map[string]domain.ChannelSelection)
+
+	for _, channel := range p.Scrapers.Telegram.Channels {
+		if channel.Selection.Kind == 0 {
+			continue
+		}
+		channelSelectorConfig := p.Selection.overriddenBy(channel.Id, channel.Selection)
+		channelLocalSelector := channelSelectorConfig.localSelector("selection override of channel "+channel.Id, clock)
+		log.WithFields(channelSelectorConfig.fields()).Infof("Selection parameters of channel %s", channel.Id)
+
+		globalSelector.Channels[channel.Id] = domain.ChannelSelection{
+			LocalSelector: channelLocalSelector,
+			Threshold:     domain.SuggestionRate(channelSelectorConfig.Threshold),
+		}
+	}
+	return globalSelector
+}
+
+type preferences struct {
+	Scrapers struct {
+		Telegram ScraperConfigEntry
+	}
+	Storage   StorageConfigEntry
+	Api       ApiConfigEntry
+	Snapshots SnapshotsConfigEntry
+	Selection SelectionConfigEntry
+}
+
+func initPreferences() preferences {
+	return loadPreferences("config.yaml")
+}
+
+func loadPreferences(path string) preferences {
+	log.Infof("Reading YAML configuration at %s", path)
+
+	yamlFile, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Fatalf("YAML config reading error: #%v ", err)
+	}
+	// YAML only overwrites what is set, so the rest keeps defaults
+	preferences := preferences{
+		Storage:   StorageConfigEntry{Retention: defaultRetentionConfigEntry()},
+		Api:       ApiConfigEntry{Consumers: []string{repost.DefaultConsumer}},
+		Selection: SelectionConfigEntry{SelectorConfigEntry: defaultSelectorConfigEntry()},
+	}
+	err = yaml.Unmarshal(yamlFile, &preferences)
+	if err != nil {
+		log.Fatalf("YAML config unmarshal error: %v", err)
+	}
+	return preferences
+}
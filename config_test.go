@@ -0,0 +1,104 @@
+package main
+
+import (
+	"github.com/alexeyvy/tjlike-agenda/infra/repost"
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoadPreferencesKeepsDefaults(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	config := `
+selection:
+  local: mad
+  mad:
+    window: 20
+api:
+  ack_on_read: true
+`
+	if err := ioutil.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatalf("Cannot write config: %v", err)
+	}
+	preferences := loadPreferences(path)
+
+	defaults := defaultSelectorConfigEntry()
+	if preferences.Selection.Local != "mad" || preferences.Selection.MAD.Window != 20 {
+		t.Errorf("Expected set parameters to be read, got %+v", preferences.Selection.SelectorConfigEntry)
+	}
+	if preferences.Selection.MAD.MinSample != defaults.MAD.MinSample || preferences.Selection.Threshold != defaults.Threshold {
+		t.Errorf("Expected omitted parameters to keep defaults, got %+v", preferences.Selection.SelectorConfigEntry)
+	}
+	if !reflect.DeepEqual(preferences.Selection.Simple.Weights, defaults.Simple.Weights) {
+		t.Errorf("Expected default weights, got %v", preferences.Selection.Simple.Weights)
+	}
+	if !preferences.Api.AckOnRead || !reflect.DeepEqual(preferences.Api.Consumers, []string{repost.DefaultConsumer}) {
+		t.Errorf("Expected the default consumer to be registered unless told otherwise, got %+v", preferences.Api)
+	}
+	if preferences.Storage.Retention != defaultRetentionConfigEntry() {
+		t.Errorf("Expected default retention, got %+v", preferences.Storage.Retention)
+	}
+}
+
+func TestChannelConfigEntryIsIdOrMapping(t *testing.T) {
+	t.Parallel()
+
+	var channels []ChannelConfigEntry
+	config := `
+- yoba_m
+- id: meduzalive
+  weight: 1.5
+  depth: {publications: 100}
+  selection: {local: velocity}
+`
+	if err := yaml.Unmarshal([]byte(config), &channels); err != nil {
+		t.Fatalf("Cannot unmarshal channels: %v", err)
+	}
+	if len(channels) != 2 {
+		t.Fatalf("Expected 2 channels, got %d", len(channels))
+	}
+	if channels[0].Id != "yoba_m" || channels[0].Weight != nil || channels[0].Selection.Kind != 0 {
+		t.Errorf("Expected a plain ID without overrides, got %+v", channels[0])
+	}
+	if channels[1].Id != "meduzalive" || channels[1].Weight == nil || *channels[1].Weight != 1.5 || channels[1].Depth.Publications != 100 {
+		t.Errorf("Expected a mapping with overrides, got %+v", channels[1])
+	}
+	if channels[1].Selection.Kind != yaml.MappingNode {
+		t.Errorf("Expected selection overrides to be kept for later, got %v", channels[1].Selection.Kind)
+	}
+}
+
+func TestSelectorConfigOverriddenByChannel(t *testing.T) {
+	t.Parallel()
+
+	var channels []ChannelConfigEntry
+	config := `
+- yoba_m
+- id: meduzalive
+  selection: {threshold: 3, simple: {weights: [2]}, mad: {window: 20}}
+`
+	if err := yaml.Unmarshal([]byte(config), &channels); err != nil {
+		t.Fatalf("Cannot unmarshal channels: %v", err)
+	}
+	base := defaultSelectorConfigEntry()
+	base.Local = "mad"
+
+	if plain := base.overriddenBy(channels[0].Id, channels[0].Selection); !reflect.DeepEqual(plain, base) {
+		t.Errorf("Expected a channel without overrides to get the base config, got %+v", plain)
+	}
+
+	overridden := base.overriddenBy(channels[1].Id, channels[1].Selection)
+	if overridden.Threshold != 3 || overridden.MAD.Window != 20 || !reflect.DeepEqual(overridden.Simple.Weights, []float64{2}) {
+		t.Errorf("Expected overrides to be applied, got %+v", overridden)
+	}
+	if overridden.Local != "mad" || overridden.MAD.MinSample != base.MAD.MinSample || overridden.Velocity != base.Velocity {
+		t.Errorf("Expected parameters not overridden to be merged from the base config, got %+v", overridden)
+	}
+	if !reflect.DeepEqual(base.Simple.Weights, defaultSelectorConfigEntry().Simple.Weights) || base.Threshold != defaultSelectorConfigEntry().Threshold {
+		t.Errorf("Expected overrides not to leak into the base config, got %+v", base)
+	}
+}
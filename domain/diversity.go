@@ -0,0 +1,110 @@
+package domain
+
+import (
+	"math"
+	"time"
+)
+
+// RepostHistory tells when publications of a channel were reposted
+type RepostHistory interface {
+	RepostTimesOfChannel(channelId string, since time.Time) []time.Time
+}
+
+// DiversityRules keep a single channel from taking over the feed. Zero value applies no rules
+type DiversityRules struct {
+	// at most MaxPerWindow reposts per channel within Window
+	MaxPerWindow int
+	Window       time.Duration
+	// minimal time between two reposts from the same channel
+	MinGap time.Duration
+	// rate of a channel is multiplied by PenaltyFactor for every repost of it within PenaltyWindow
+	PenaltyFactor float64
+	PenaltyWindow time.Duration
+}
+
+func (r DiversityRules) isEmpty() bool {
+	return r.MaxPerWindow <= 0 && r.MinGap <= 0 && !r.penalizes()
+}
+
+func (r DiversityRules) penalizes() bool {
+	return r.PenaltyWindow > 0 && r.PenaltyFactor > 0 && r.PenaltyFactor != 1
+}
+
+func (r DiversityRules) lookBehind() time.Duration {
+	return time.Duration(math.Max(float64(r.Window), math.Max(float64(r.MinGap), float64(r.PenaltyWindow))))
+}
+
+// channelRecord tracks reposts of a channel, both from the history and picked during the current traversal
+type channelRecord struct {
+	repostTimes []time.Time
+}
+
+func (c *channelRecord) countSince(since time.Time) int {
+	var count int
+	for _, repostedAt := range c.repostTimes {
+		if !repostedAt.Before(since) {
+			count++
+		}
+	}
+	return count
+}
+
+// diversityTracker applies the rules to candidates of a single traversal
+type diversityTracker struct {
+	rules   DiversityRules
+	history RepostHistory
+	current time.Time
+	records map[string]*channelRecord
+}
+
+func newDiversityTracker(rules DiversityRules, history RepostHistory, current time.Time) *diversityTracker {
+	return &diversityTracker{rules, history, current, make(map[string]*channelRecord)}
+}
+
+func (t *diversityTracker) record(channelId string) *channelRecord {
+	record, found := t.records[channelId]
+	if !found {
+		record = &channelRecord{}
+		if t.history != nil {
+			record.repostTimes = t.history.RepostTimesOfChannel(channelId, t.current.Add(-t.rules.lookBehind()))
+		}
+		t.records[channelId] = record
+	}
+	return record
+}
+
+// penalty is a multiplier for the channel's rates, the more recent wins the lower it is
+func (t *diversityTracker) penalty(channelId string) float64 {
+	if !t.rules.penalizes() {
+		return 1
+	}
+	wins := t.record(channelId).countSince(t.current.Add(-t.rules.PenaltyWindow))
+	return math.Pow(t.rules.PenaltyFactor, float64(wins))
+}
+
+// allows tells whether one more repost from the channel is allowed without counting it in
+func (t *diversityTracker) allows(channelId string) bool {
+	record := t.record(channelId)
+	if t.rules.MaxPerWindow > 0 && record.countSince(t.current.Add(-t.rules.Window)) >= t.rules.MaxPerWindow {
+		return false
+	}
+	if t.rules.MinGap > 0 && record.countSince(t.current.Add(-t.rules.MinGap)) > 0 {
+		return false
+	}
+	return true
+}
+
+// admit tells whether one more repost from the channel is allowed and counts it in if so
+func (t *diversityTracker) admit(channelId string) bool {
+	if !t.allows(channelId) {
+		return false
+	}
+	t.count(channelId)
+	return true
+}
+
+// count records one more repost from the channel regardless of the rules
+func (t *diversityTracker) count(channelId string) {
+	record := t.record(channelId)
+	record.repostTimes = append(record.repostTimes, t.current)
+}
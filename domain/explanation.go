@@ -0,0 +1,55 @@
+package domain
+
+// number of candidates that were not selected kept in the explanation
+const runnersUpCount = 3
+
+// Explanation tells how the rate of a selected publication was obtained
+type Explanation struct {
+	// local selector that rated the publication and what it based the rate on
+	Selector string
+	Inputs   map[string]float64
+	Factors  map[string]float64
+	// rate given by the local selector, before rules and channel preferences
+	LocalRate SuggestionRate
+	// rate the publication had to reach unless forced
+	Threshold SuggestionRate
+	// publication the rate was given to, differs from the selected one if it's a copy of the same story
+	RatedPublicationId PublicationId
+	// best candidates that were not selected
+	RunnersUp []RunnerUp
+}
+
+// withFactor doesn't touch factors of the original explanation
+func (e Explanation) withFactor(name string, value float64) Explanation {
+	factors := make(map[string]float64, len(e.Factors)+1)
+	for k, v := range e.Factors {
+		factors[k] = v
+	}
+	factors[name] = value
+	e.Factors = factors
+	return e
+}
+
+type RunnerUp struct {
+	PublicationId PublicationId
+	ChannelId     string
+	Rate          SuggestionRate
+}
+
+// runnersUp lists best candidates of the ranking that didn't make it to the selections
+func runnersUp(ranked []Selection, selections []Selection) []RunnerUp {
+	selected := make(map[PublicationId]bool, len(selections))
+	for _, selection := range selections {
+		selected[selection.Publication.Id] = true
+	}
+	var runnersUp []RunnerUp
+	for _, candidate := range ranked {
+		if len(runnersUp) == runnersUpCount {
+			break
+		}
+		if !selected[candidate.Publication.Id] {
+			runnersUp = append(runnersUp, RunnerUp{candidate.Publication.Id, candidate.Channel.Id, candidate.Rate})
+		}
+	}
+	return runnersUp
+}
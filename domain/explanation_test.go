@@ -0,0 +1,47 @@
+package domain
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSelectionExplanation(t *testing.T) {
+	t.Parallel()
+	postedAt := time.Unix(1661773286, 0)
+
+	channel := NewChannel("news")
+	channel.Weight = 2
+	publications := []Publication{
+		NewPublication("news/1", 100, postedAt),
+		NewPublication("news/2", 100, postedAt),
+		NewPublication("news/3", 100, postedAt),
+		NewPublication("news/4", 200, postedAt),
+		NewPublication("news/5", 1000, postedAt),
+	}
+	selector := NewGlobalSelector(NewLocalSelector())
+	selections, err := selector.SelectPublications(map[Channel][]Publication{channel: publications}, notExists)
+	if err != nil || len(selections) != 1 {
+		t.Fatalf("Expected a single selection, got %v (%v)", selections, err)
+	}
+
+	explanation := selections[0].Explanation
+	if explanation.Selector != "simple" || explanation.Threshold != DefaultSuggestionRateThreshold {
+		t.Errorf("Expected simple selector with default threshold, got %s with %f", explanation.Selector, explanation.Threshold)
+	}
+	// 1000/200*1.5 + 1000/100*1.2 + 1000/100*1
+	if explanation.LocalRate != 29.5 || selections[0].Rate != 59 {
+		t.Errorf("Expected local rate 29.5 weighted up to 59, got %f and %f", explanation.LocalRate, selections[0].Rate)
+	}
+	if explanation.Inputs["views"] != 1000 || explanation.Inputs["neighbour_1_views"] != 200 {
+		t.Errorf("Expected views of the publication and its neighbours among inputs, got %v", explanation.Inputs)
+	}
+	if explanation.Factors["overweight_1"] != 5 || explanation.Factors["weight_1"] != 1.5 || explanation.Factors["channel_weight"] != 2 {
+		t.Errorf("Expected overweights, neighbour and channel weights among factors, got %v", explanation.Factors)
+	}
+	// 200/100*1.5 + 200/100*1.2 + 200/100*1, weighted
+	expectedRunnersUp := []RunnerUp{{"news/4", "news", 14.8}}
+	if !reflect.DeepEqual(explanation.RunnersUp, expectedRunnersUp) {
+		t.Errorf("Expected runners-up %v, got %v", expectedRunnersUp, explanation.RunnersUp)
+	}
+}
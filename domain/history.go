@@ -0,0 +1,22 @@
+package domain
+
+import "time"
+
+// ViewSample is a view counter of a publication observed at some moment
+type ViewSample struct {
+	ViewAmount int
+	ObservedAt time.Time
+}
+
+// Velocity is views gained per minute between the two latest samples
+func Velocity(samples []ViewSample) (float64, bool) {
+	if len(samples) < 2 {
+		return 0, false
+	}
+	last, prev := samples[len(samples)-1], samples[len(samples)-2]
+	minutes := last.ObservedAt.Sub(prev.ObservedAt).Minutes()
+	if minutes <= 0 {
+		return 0, false
+	}
+	return float64(last.ViewAmount-prev.ViewAmount) / minutes, true
+}
@@ -0,0 +1,109 @@
+package domain
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"math"
+	"sort"
+)
+
+// makes MAD comparable to standard deviation on normally distributed views
+const madConsistency = 1.4826
+
+type MADParams struct {
+	// number of preceding neighbours the median is taken over
+	Window int
+	// fewer preceding neighbours give no idea of what is usual for the channel, such publications aren't rated
+	MinSample int
+	// scale floor relative to the median, so that a channel with identical view counters doesn't yield infinite rates
+	MinRelativeScale float64
+}
+
+func DefaultMADParams() MADParams {
+	return MADParams{Window: 10, MinSample: 3, MinRelativeScale: 0.05}
+}
+
+func (p MADParams) Validate() error {
+	if p.MinSample < 1 {
+		return fmt.Errorf("min sample must be positive, got %d", p.MinSample)
+	}
+	if p.Window < p.MinSample {
+		return fmt.Errorf("window of %d can never reach min sample of %d", p.Window, p.MinSample)
+	}
+	if p.MinRelativeScale < 0 {
+		return fmt.Errorf("min relative scale can't be negative, got %f", p.MinRelativeScale)
+	}
+	return nil
+}
+
+// madLocalSelector scores publications by how far their views sit from the rolling median of neighbours,
+// measured in MAD (median absolute deviation) units. Unlike ratios to neighbours, a single outlier or zero views can't break it
+type madLocalSelector struct {
+	params MADParams
+}
+
+func NewMADLocalSelector(params MADParams) *madLocalSelector {
+	return &madLocalSelector{params}
+}
+
+func median(values []float64) float64 {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	middle := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[middle-1] + sorted[middle]) / 2
+	}
+	return sorted[middle]
+}
+
+// baseline takes up to window publications preceding the given one. Following ones are never taken,
+// as they had less time to collect views and would make the oldest publications look inflated
+func baseline(publications []Publication, key int, window int) []float64 {
+	views := make([]float64, 0, window)
+	for k := key - 1; k >= 0 && len(views) < window; k-- {
+		views = append(views, float64(publications[k].ViewAmount))
+	}
+	return views
+}
+
+// robustScore is a number of scaled MADs the value sits above the median of the baseline
+func robustScore(value float64, baseline []float64, minRelativeScale float64) (score, med, scale float64) {
+	med = median(baseline)
+	deviations := make([]float64, len(baseline))
+	for k, v := range baseline {
+		deviations[k] = math.Abs(v - med)
+	}
+	scale = math.Max(madConsistency*median(deviations), math.Max(minRelativeScale*med, 1))
+	return (value - med) / scale, med, scale
+}
+
+func (s *madLocalSelector) RankPublications(publications []Publication) []RatedPublication {
+	publications = withKnownViews(publications)
+	var rated []RatedPublication
+
+	for key, publication := range publications {
+		neighbours := baseline(publications, key, s.params.Window)
+		if len(neighbours) < s.params.MinSample {
+			continue
+		}
+		rate, med, scale := robustScore(float64(publication.ViewAmount), neighbours, s.params.MinRelativeScale)
+		log.WithFields(log.Fields{
+			"id":     publication.Id,
+			"rate":   rate,
+			"median": med,
+			"scale":  scale,
+		}).Debug("Rated publication of channel")
+
+		rated = append(rated, RatedPublication{publication, SuggestionRate(rate), Explanation{
+			Selector: "mad",
+			Inputs:   map[string]float64{"views": float64(publication.ViewAmount), "neighbours": float64(len(neighbours))},
+			Factors:  map[string]float64{"median": med, "scale": scale},
+		}})
+	}
+
+	return sortByRate(rated)
+}
+
+func (s *madLocalSelector) SelectPublication(publications []Publication) (Publication, SuggestionRate) {
+	return topRated(s.RankPublications(publications))
+}
@@ -0,0 +1,57 @@
+package domain
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestMADSelectorIsRobust(t *testing.T) {
+	t.Parallel()
+	postedAt := time.Unix(1661773286, 0)
+	views := []int{1000, 0, 1100, 950, 1050, 100000, 1000, 5000, 980}
+	publications := make([]Publication, len(views))
+	for k, v := range views {
+		publications[k] = NewPublication("tg/"+string(rune('a'+k)), v, postedAt.Add(time.Duration(k)*time.Hour))
+	}
+
+	selected, rate := NewMADLocalSelector(DefaultMADParams()).SelectPublication(publications)
+	if selected.Id != "tg/f" {
+		t.Errorf("Expected the outlier to be selected, got %s", selected.Id)
+	}
+	if math.IsInf(float64(rate), 0) || math.IsNaN(float64(rate)) || rate < 4 {
+		t.Errorf("Expected finite rate well above threshold, got %f", rate)
+	}
+
+	// zero views of a neighbour and identical counters must not blow the rate up
+	flat := []Publication{
+		NewPublication("tg/1", 0, postedAt),
+		NewPublication("tg/2", 0, postedAt),
+		NewPublication("tg/3", 0, postedAt),
+		NewPublication("tg/4", 3, postedAt),
+	}
+	_, rate = NewMADLocalSelector(DefaultMADParams()).SelectPublication(flat)
+	if rate != 3 {
+		t.Errorf("Expected rate of 3 on flat channel with scale floor of 1 view, got %f", rate)
+	}
+
+	_, rate = NewMADLocalSelector(DefaultMADParams()).SelectPublication(flat[:3])
+	if rate != 0 {
+		t.Errorf("Too few publications must not be rated, got %f", rate)
+	}
+}
+
+func TestMADSelectorOnUniformChannel(t *testing.T) {
+	t.Parallel()
+	postedAt := time.Unix(1661773286, 0)
+	// posted every hour, each has collected views in proportion to its age
+	publications := make([]Publication, 12)
+	for k := range publications {
+		publications[k] = NewPublication("tg/"+string(rune('a'+k)), 100*(len(publications)-k), postedAt.Add(time.Duration(k)*time.Hour))
+	}
+
+	// only trending publications are ranked, so nothing is expected at all
+	if rated := NewMADLocalSelector(DefaultMADParams()).RankPublications(publications); len(rated) != 0 {
+		t.Errorf("Expected no positive rate on a uniform channel, got %+v", rated)
+	}
+}
@@ -4,10 +4,40 @@ import "time"
 
 type PublicationId string
 
+// UnknownViewAmount marks publications whose view counter couldn't be read, selectors skip them
+const UnknownViewAmount = -1
+
 type Publication struct {
 	Id         PublicationId
+	ChannelId  string
 	ViewAmount int
 	PostedAt   time.Time
+	Content    Content
+}
+
+func (p Publication) ViewsKnown() bool {
+	return p.ViewAmount != UnknownViewAmount
+}
+
+// Content is everything needed to render a publication without fetching it once again
+type Content struct {
+	Text          string
+	HTML          string
+	Photos        []string // thumbnail URLs
+	Videos        []string // thumbnail URLs
+	Links         []string
+	LinkPreview   *LinkPreview
+	ForwardedFrom string
+	ReplyTo       PublicationId
+	Hashtags      []string
+}
+
+type LinkPreview struct {
+	URL         string
+	SiteName    string
+	Title       string
+	Description string
+	ImageURL    string
 }
 
 func NewPublication(id string, viewAmount int, postedAt time.Time) Publication {
@@ -15,18 +45,53 @@ func NewPublication(id string, viewAmount int, postedAt time.Time) Publication {
 }
 
 type Channel struct {
-	Id       string
-	priority int
+	Id string
+	// channels of higher priority tier win over lower ones regardless of the rate
+	Priority int
+	// multiplies suggestion rate of the channel's publications when competing with other channels
+	Weight float64
+	// publications rated lower are never selected from the channel
+	MinRate SuggestionRate
+	Info    ChannelInfo
 }
 
 func NewChannel(id string) Channel {
-	return Channel{Id: id}
+	return Channel{Id: id, Weight: 1}
+}
+
+// UnknownSubscriberCount marks channels whose subscriber counter couldn't be read
+const UnknownSubscriberCount = -1
+
+// ChannelInfo is what the platform tells about the channel itself
+type ChannelInfo struct {
+	Id          string
+	Title       string
+	Description string
+	AvatarURL   string
+	Subscribers int
+}
+
+func NewChannelInfo(id string) ChannelInfo {
+	return ChannelInfo{Id: id, Subscribers: UnknownSubscriberCount}
+}
+
+func (c ChannelInfo) SubscribersKnown() bool {
+	return c.Subscribers != UnknownSubscriberCount
+}
+
+// HeaderKnown tells whether anything besides ID was scraped
+func (c ChannelInfo) HeaderKnown() bool {
+	return c.Title != "" || c.Description != "" || c.AvatarURL != "" || c.SubscribersKnown()
 }
 
 type Repost struct {
 	Pub        Publication
 	RepostedAt time.Time
 	Rate       SuggestionRate
+	Channel    ChannelInfo
+	// rules that affected the selection of the publication
+	Rules       []AppliedRule
+	Explanation Explanation
 }
 
 func NewRepost(publication Publication, repostedAt time.Time, rate SuggestionRate) Repost {
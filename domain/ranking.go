@@ -0,0 +1,129 @@
+package domain
+
+import (
+	"math"
+	"sort"
+)
+
+// RatedPublication is a publication along with the rate it was given by a local selector
+type RatedPublication struct {
+	Publication Publication
+	Rate        SuggestionRate
+	Explanation Explanation
+}
+
+// sortByRate orders publications from the most trending down, dropping ones that are not trending at all
+func sortByRate(rated []RatedPublication) []RatedPublication {
+	trending := make([]RatedPublication, 0, len(rated))
+	for _, r := range rated {
+		if r.Rate > 0 {
+			trending = append(trending, r)
+		}
+	}
+	sort.SliceStable(trending, func(i, j int) bool {
+		return trending[i].Rate > trending[j].Rate
+	})
+	return trending
+}
+
+// topRated is what SelectPublication of local selectors returns
+func topRated(ranked []RatedPublication) (Publication, SuggestionRate) {
+	if len(ranked) == 0 {
+		return Publication{}, SuggestionRate(0)
+	}
+	return ranked[0].Publication, ranked[0].Rate
+}
+
+// Selection is a publication picked by the global selector, Rate is weighted according to the channel preferences
+type Selection struct {
+	Publication Publication
+	Rate        SuggestionRate
+	Channel     Channel
+	Rules       []AppliedRule
+	// forced selections bypass thresholds, limits and diversity rules
+	Forced      bool
+	Explanation Explanation
+}
+
+const (
+	// SelectionModeTop picks N most trending publications
+	SelectionModeTop = "top"
+	// SelectionModeThreshold picks every publication rated at least Threshold
+	SelectionModeThreshold = "threshold"
+	// SelectionModeDynamic picks publications that stand out of the rest, i.e. rated at least Deviations standard deviations above the mean
+	SelectionModeDynamic = "dynamic"
+)
+
+// SelectionLimit defines how many publications are picked per traversal. Zero value picks the single most trending one
+type SelectionLimit struct {
+	Mode string
+	// number of publications in top mode, upper bound in other modes. 0 means no bound
+	N          int
+	Threshold  SuggestionRate
+	Deviations float64
+}
+
+// apply picks selections the limit allows, forced ones are always picked
+func (l SelectionLimit) apply(selections []Selection) []Selection {
+	var forced, ranked []Selection
+	for _, selection := range selections {
+		if selection.Forced {
+			forced = append(forced, selection)
+		} else {
+			ranked = append(ranked, selection)
+		}
+	}
+	return append(forced, l.pick(ranked)...)
+}
+
+func (l SelectionLimit) pick(ranked []Selection) []Selection {
+	var picked []Selection
+	switch l.Mode {
+	case SelectionModeThreshold:
+		for _, selection := range ranked {
+			if selection.Rate >= l.Threshold {
+				picked = append(picked, selection)
+			}
+		}
+	case SelectionModeDynamic:
+		cutoff := dynamicCutoff(ranked, l.Deviations)
+		for k, selection := range ranked {
+			// the leader is always picked, even if all rates are the same
+			if k == 0 || float64(selection.Rate) >= cutoff {
+				picked = append(picked, selection)
+			}
+		}
+	default:
+		picked = ranked
+		if l.N <= 0 {
+			return picked[:minInt(1, len(picked))]
+		}
+	}
+
+	if l.N > 0 && len(picked) > l.N {
+		picked = picked[:l.N]
+	}
+	return picked
+}
+
+func dynamicCutoff(ranked []Selection, deviations float64) float64 {
+	if len(ranked) == 0 {
+		return 0
+	}
+	var sum, sumSquares float64
+	for _, selection := range ranked {
+		sum += float64(selection.Rate)
+		sumSquares += float64(selection.Rate) * float64(selection.Rate)
+	}
+	n := float64(len(ranked))
+	mean := sum / n
+	variance := math.Max(sumSquares/n-mean*mean, 0)
+	return mean + deviations*math.Sqrt(variance)
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,169 @@
+package domain
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+type RuleAction string
+
+const (
+	// RuleActionExclude never selects matching publications, it wins over any other action
+	RuleActionExclude RuleAction = "exclude"
+	// RuleActionMultiply multiplies the rate by Factor before it's compared to thresholds
+	RuleActionMultiply RuleAction = "multiply"
+	// RuleActionForceInclude selects matching publications regardless of the rate, thresholds, limits and diversity rules
+	RuleActionForceInclude RuleAction = "force_include"
+)
+
+// Rule matches a publication if it comes from one of Channels (any channel if empty)
+// and any of Keywords, Hashtags, Links or Pattern is found in it. Keywords and hashtags are case-insensitive
+type Rule struct {
+	Name     string
+	Channels []string
+	Keywords []string
+	Hashtags []string
+	// parts of link URLs
+	Links   []string
+	Pattern *regexp.Regexp
+	Action  RuleAction
+	Factor  float64
+}
+
+type Rules []Rule
+
+func (r Rule) Validate() error {
+	if r.Name == "" {
+		return errors.New("rule must have a name")
+	}
+	if r.channelsOnly() && len(r.Channels) == 0 {
+		return fmt.Errorf("rule %s matches nothing", r.Name)
+	}
+	switch r.Action {
+	case RuleActionExclude, RuleActionForceInclude:
+	case RuleActionMultiply:
+		if r.Factor < 0 {
+			return fmt.Errorf("factor of rule %s can't be negative, got %f", r.Name, r.Factor)
+		}
+	default:
+		return fmt.Errorf("unknown action %s of rule %s", r.Action, r.Name)
+	}
+	return nil
+}
+
+func (r Rule) channelsOnly() bool {
+	return len(r.Keywords) == 0 && len(r.Hashtags) == 0 && len(r.Links) == 0 && r.Pattern == nil
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r Rule) matches(channel Channel, publication Publication) bool {
+	if len(r.Channels) > 0 && !containsFold(r.Channels, channel.Id) {
+		return false
+	}
+	// a rule scoped to channels only matches all of their publications
+	if r.channelsOnly() {
+		return true
+	}
+
+	content := publication.Content
+	text := strings.ToLower(content.Text)
+	for _, keyword := range r.Keywords {
+		if strings.Contains(text, strings.ToLower(keyword)) {
+			return true
+		}
+	}
+	for _, hashtag := range r.Hashtags {
+		if containsFold(content.Hashtags, "#"+strings.TrimPrefix(hashtag, "#")) {
+			return true
+		}
+	}
+	links := content.Links
+	if content.LinkPreview != nil {
+		links = append(append([]string(nil), links...), content.LinkPreview.URL)
+	}
+	for _, part := range r.Links {
+		for _, link := range links {
+			if strings.Contains(strings.ToLower(link), strings.ToLower(part)) {
+				return true
+			}
+		}
+	}
+	return r.Pattern != nil && r.Pattern.MatchString(content.Text)
+}
+
+// AppliedRule is recorded on the repost to tell how rules affected its selection
+type AppliedRule struct {
+	Name   string
+	Action RuleAction
+	Factor float64 `json:",omitempty"`
+}
+
+// ruledPublication is a publication with the rules applied on top of the rate given by the local selector
+type ruledPublication struct {
+	RatedPublication
+	localRate SuggestionRate
+	applied   []AppliedRule
+	forced    bool
+}
+
+// apply runs all the rules against publications of the channel. Excluded publications are left out,
+// forced ones are added even if not rated by the local selector
+func (rules Rules) apply(channel Channel, publications []Publication, rated []RatedPublication) []ruledPublication {
+	if len(rules) == 0 {
+		ruled := make([]ruledPublication, len(rated))
+		for k, r := range rated {
+			ruled[k] = ruledPublication{RatedPublication: r, localRate: r.Rate}
+		}
+		return ruled
+	}
+
+	rates := make(map[PublicationId]RatedPublication, len(rated))
+	for _, r := range rated {
+		rates[r.Publication.Id] = r
+	}
+	var ruled []ruledPublication
+	for _, publication := range publications {
+		ratedPublication, isRated := rates[publication.Id]
+		if !isRated {
+			ratedPublication = RatedPublication{Publication: publication}
+		}
+		candidate := ruledPublication{RatedPublication: ratedPublication, localRate: ratedPublication.Rate}
+		var excluded bool
+		for _, rule := range rules {
+			if !rule.matches(channel, publication) {
+				continue
+			}
+			switch rule.Action {
+			case RuleActionExclude:
+				excluded = true
+			case RuleActionMultiply:
+				candidate.Rate *= SuggestionRate(rule.Factor)
+			case RuleActionForceInclude:
+				candidate.forced = true
+			}
+			applied := AppliedRule{Name: rule.Name, Action: rule.Action}
+			if rule.Action == RuleActionMultiply {
+				applied.Factor = rule.Factor
+			}
+			candidate.applied = append(candidate.applied, applied)
+		}
+		if !excluded && (isRated || candidate.forced) {
+			ruled = append(ruled, candidate)
+		}
+	}
+	sort.SliceStable(ruled, func(i, j int) bool {
+		return ruled[i].Rate > ruled[j].Rate
+	})
+	return ruled
+}
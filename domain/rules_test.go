@@ -0,0 +1,88 @@
+package domain
+
+import (
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestGlobalSelectorRules(t *testing.T) {
+	t.Parallel()
+	postedAt := time.Unix(1661773286, 0)
+
+	channel := NewChannel("news")
+	ad := NewPublication("news/ad", 50, postedAt)
+	ad.Content = Content{Text: "Best deals of the week #реклама", Hashtags: []string{"#реклама"}}
+	marked := NewPublication("news/marked", 40, postedAt)
+	marked.Content = Content{Text: "Sponsored. ERID: 2VtzqwX"}
+	elections := NewPublication("news/elections", 10, postedAt)
+	elections.Content = Content{Text: "Turnout at the elections hit a record"}
+	digest := NewPublication("news/digest", 0, postedAt)
+	digest.Content = Content{Links: []string{"https://example.com/digest/today"}}
+	regular := NewPublication("news/regular", 20, postedAt)
+
+	selector := NewGlobalSelector(viewsSelector{})
+	selector.Limit = SelectionLimit{Mode: SelectionModeTop, N: 1}
+	selector.Rules = Rules{
+		{Name: "ads", Hashtags: []string{"реклама"}, Keywords: []string{"erid:"}, Action: RuleActionExclude},
+		{Name: "elections", Pattern: regexp.MustCompile(`(?i)election`), Action: RuleActionMultiply, Factor: 3},
+		{Name: "digest", Channels: []string{"news"}, Links: []string{"example.com/digest"}, Action: RuleActionForceInclude},
+	}
+	selections, err := selector.SelectPublications(
+		map[Channel][]Publication{channel: {ad, marked, elections, digest, regular}},
+		notExists,
+	)
+	if err != nil {
+		t.Fatalf("SelectPublications() threw an error: %v", err)
+	}
+
+	type table struct {
+		id    PublicationId
+		rate  SuggestionRate
+		rules []AppliedRule
+	}
+	expected := []table{
+		{"news/digest", 0, []AppliedRule{{Name: "digest", Action: RuleActionForceInclude}}},
+		{"news/elections", 30, []AppliedRule{{Name: "elections", Action: RuleActionMultiply, Factor: 3}}},
+	}
+	if len(selections) != len(expected) {
+		t.Fatalf("Expected %d selections, got %d: %v", len(expected), len(selections), selections)
+	}
+	for k, expectation := range expected {
+		got := selections[k]
+		if got.Publication.Id != expectation.id || got.Rate != expectation.rate || !reflect.DeepEqual(got.Rules, expectation.rules) {
+			t.Errorf(
+				"Selection %d: got %s with rate %f and rules %v, want %s with rate %f and rules %v",
+				k,
+				got.Publication.Id,
+				got.Rate,
+				got.Rules,
+				expectation.id,
+				expectation.rate,
+				expectation.rules,
+			)
+		}
+	}
+}
+
+func TestRuleValidate(t *testing.T) {
+	t.Parallel()
+
+	type table struct {
+		rule  Rule
+		valid bool
+	}
+	for _, expectation := range []table{
+		{Rule{Name: "ads", Keywords: []string{"erid:"}, Action: RuleActionExclude}, true},
+		{Rule{Name: "partner", Channels: []string{"news"}, Action: RuleActionMultiply, Factor: 2}, true},
+		{Rule{Name: "everything", Action: RuleActionExclude}, false},
+		{Rule{Keywords: []string{"erid:"}, Action: RuleActionExclude}, false},
+		{Rule{Name: "ads", Keywords: []string{"erid:"}, Action: "hide"}, false},
+		{Rule{Name: "ads", Keywords: []string{"erid:"}, Action: RuleActionMultiply, Factor: -1}, false},
+	} {
+		if err := expectation.rule.Validate(); (err == nil) != expectation.valid {
+			t.Errorf("Rule %+v: got error %v, want valid: %t", expectation.rule, err, expectation.valid)
+		}
+	}
+}
@@ -2,98 +2,266 @@ package domain
 
 import (
 	"errors"
+	"fmt"
 	log "github.com/sirupsen/logrus"
+	"sort"
+	"strconv"
+	"time"
 )
 
 type (
 	SuggestionRate      float64
-	simpleLocalSelector struct{}
+	simpleLocalSelector struct {
+		params SimpleParams
+	}
 )
 
-func (s *simpleLocalSelector) SelectPublication(publications []Publication) (Publication, SuggestionRate) {
-	var (
-		maxRate                float64
-		rate                   float64
-		topPublication         Publication
-		prevOverweight         = 1.0
-		prevPrevOverweight     = 1.0
-		prevPrevPrevOverweight = 1.0
-	)
+// SimpleParams weigh how many times views of a publication exceed views of each preceding one, nearest neighbour first
+type SimpleParams struct {
+	Weights []float64
+}
+
+func DefaultSimpleParams() SimpleParams {
+	return SimpleParams{Weights: []float64{1.5, 1.2, 1}}
+}
+
+func (p SimpleParams) Validate() error {
+	if len(p.Weights) == 0 {
+		return errors.New("at least one neighbour weight is required")
+	}
+	for _, weight := range p.Weights {
+		if weight < 0 {
+			return fmt.Errorf("neighbour weights can't be negative, got %v", p.Weights)
+		}
+	}
+	return nil
+}
+
+func (s *simpleLocalSelector) RankPublications(publications []Publication) []RatedPublication {
+	publications = withKnownViews(publications)
+	var rated []RatedPublication
+	overweights := make([]float64, len(s.params.Weights))
 
 	for key, publication := range publications {
-		if key <= 2 {
+		if key < len(s.params.Weights) {
 			continue
 		}
-		prevOverweight = float64(publication.ViewAmount) / float64((publications[key-1]).ViewAmount)
-		prevPrevOverweight = float64(publication.ViewAmount) / float64((publications[key-2]).ViewAmount)
-		prevPrevPrevOverweight = float64(publication.ViewAmount) / float64((publications[key-3]).ViewAmount)
-		if prevOverweight <= 1 {
+		for k := range overweights {
+			overweights[k] = float64(publication.ViewAmount) / float64((publications[key-1-k]).ViewAmount)
+		}
+		if overweights[0] <= 1 {
 			continue
 		}
-		rate = prevOverweight*1.5 + prevPrevOverweight*1.2 + prevPrevPrevOverweight
-		if rate > maxRate {
-			log.WithFields(log.Fields{
-				"id":                 publication.Id,
-				"rate":               rate,
-				"prevOverweight":     prevOverweight,
-				"prevPrevOverweight": prevPrevOverweight,
-			}).Debug("New leader of channel")
-
-			maxRate = rate
-			topPublication = publication
+		var rate float64
+		for k, weight := range s.params.Weights {
+			rate += overweights[k] * weight
+		}
+		log.WithFields(log.Fields{
+			"id":          publication.Id,
+			"rate":        rate,
+			"overweights": overweights,
+		}).Debug("Rated publication of channel")
+
+		explanation := Explanation{
+			Selector: "simple",
+			Inputs:   map[string]float64{"views": float64(publication.ViewAmount)},
+			Factors:  make(map[string]float64, 2*len(overweights)),
+		}
+		for k, overweight := range overweights {
+			neighbour := strconv.Itoa(k + 1)
+			explanation.Inputs["neighbour_"+neighbour+"_views"] = float64(publications[key-1-k].ViewAmount)
+			explanation.Factors["overweight_"+neighbour] = overweight
+			explanation.Factors["weight_"+neighbour] = s.params.Weights[k]
 		}
+		rated = append(rated, RatedPublication{publication, SuggestionRate(rate), explanation})
 	}
 
-	if maxRate == 0 {
-		return Publication{}, SuggestionRate(0)
+	return sortByRate(rated)
+}
+
+func (s *simpleLocalSelector) SelectPublication(publications []Publication) (Publication, SuggestionRate) {
+	return topRated(s.RankPublications(publications))
+}
+
+// withKnownViews drops publications whose view amount is unknown, as they can't be compared to others
+func withKnownViews(publications []Publication) []Publication {
+	known := make([]Publication, 0, len(publications))
+	for _, publication := range publications {
+		if publication.ViewsKnown() {
+			known = append(known, publication)
+		}
 	}
-	return topPublication, SuggestionRate(maxRate)
+	return known
 }
+
 func NewLocalSelector() *simpleLocalSelector {
-	return &simpleLocalSelector{}
+	return NewSimpleLocalSelector(DefaultSimpleParams())
+}
+
+func NewSimpleLocalSelector(params SimpleParams) *simpleLocalSelector {
+	return &simpleLocalSelector{params}
 }
 
 type LocalSelector interface {
 	SelectPublication([]Publication) (Publication, SuggestionRate)
+	// RankPublications rates every trending publication of the channel, the most trending goes first
+	RankPublications([]Publication) []RatedPublication
+}
+
+// ChannelSelection overrides how publications of a particular channel are rated
+type ChannelSelection struct {
+	LocalSelector LocalSelector
+	Threshold     SuggestionRate
 }
 
 type SimpleGlobalSelector struct {
 	LocalSelector LocalSelector
+	// publications rated lower are never selected
+	Threshold SuggestionRate
+	// overrides of LocalSelector and Threshold by channel ID
+	Channels  map[string]ChannelSelection
+	Limit     SelectionLimit
+	Diversity DiversityRules
+	// near-duplicate publications across channels are selected once
+	Stories StoryRules
+	// exclude, boost or force publications by their content or channel
+	Rules Rules
+	// required for diversity rules to take past reposts into account
+	History RepostHistory
+	// diversity windows end at the moment it tells, e.g. a simulated one when replaying history
+	Clock func() time.Time
 }
 
 func NewGlobalSelector(localSelector LocalSelector) *SimpleGlobalSelector {
-	return &SimpleGlobalSelector{localSelector}
+	return &SimpleGlobalSelector{LocalSelector: localSelector, Threshold: DefaultSuggestionRateThreshold, Clock: time.Now}
 }
 
 var ErrExhausted = errors.New("all channels exhausted")
 
-const suggestionRateThreshold = 4
+const DefaultSuggestionRateThreshold = 4
 
+func (s *SimpleGlobalSelector) selectionOf(channel Channel) ChannelSelection {
+	if override, found := s.Channels[channel.Id]; found {
+		return override
+	}
+	return ChannelSelection{s.LocalSelector, s.Threshold}
+}
+
+// SelectPublication picks the single most trending publication across all channels
 func (s *SimpleGlobalSelector) SelectPublication(
 	candidates map[Channel][]Publication,
 	exists func(publication Publication) bool,
 ) (Publication, SuggestionRate, error) {
-	maxSuggestionRate := 0.0
-	var selectedPublication Publication
+	ranked := s.rank(candidates, exists)
+	if len(ranked) == 0 {
+		return Publication{}, SuggestionRate(0), ErrExhausted
+	}
 
-	// @TODO implement cross-channel selection rules, including chanel priorities
+	return ranked[0].Publication, ranked[0].Rate, nil
+}
 
-	for _, channelPublications := range candidates {
-		msg, suggestionRate := s.LocalSelector.SelectPublication(channelPublications)
-		if exists(msg) {
-			continue
+// SelectPublications picks as many trending publications across all channels as the limit allows, the most trending goes first
+func (s *SimpleGlobalSelector) SelectPublications(
+	candidates map[Channel][]Publication,
+	exists func(publication Publication) bool,
+) ([]Selection, error) {
+	ranked := s.rank(candidates, exists)
+	selections := s.Limit.apply(ranked)
+	if len(selections) == 0 {
+		return nil, ErrExhausted
+	}
+	runnersUp := runnersUp(ranked, selections)
+	for k := range selections {
+		selections[k].Explanation.RunnersUp = runnersUp
+	}
+
+	return selections, nil
+}
+
+// rank orders trending publications of all channels by priority tier, then by weighted rate.
+// Rules are applied on top of rates given by local selectors, forced publications go first.
+// Copies of the same story are collapsed into one. Publications of channels that are not allowed to be reposted due to diversity rules are left out
+func (s *SimpleGlobalSelector) rank(
+	candidates map[Channel][]Publication,
+	exists func(publication Publication) bool,
+) []Selection {
+	var (
+		ranked    []Selection
+		diversity *diversityTracker
+	)
+	if !s.Diversity.isEmpty() {
+		diversity = newDiversityTracker(s.Diversity, s.History, s.Clock())
+	}
+
+	for channel, channelPublications := range candidates {
+		selection := s.selectionOf(channel)
+		rated := selection.LocalSelector.RankPublications(channelPublications)
+		for _, ruled := range s.Rules.apply(channel, channelPublications, rated) {
+			if !ruled.forced && (ruled.Rate < selection.Threshold || ruled.Rate < channel.MinRate) {
+				continue
+			}
+			if exists(ruled.Publication) {
+				continue
+			}
+			explanation := ruled.Explanation.withFactor("channel_weight", channel.Weight)
+			explanation.LocalRate = ruled.localRate
+			explanation.Threshold = selection.Threshold
+			if channel.MinRate > explanation.Threshold {
+				explanation.Threshold = channel.MinRate
+			}
+			weightedRate := float64(ruled.Rate) * channel.Weight
+			// blocked channels are left out before stories are collapsed, so that they never represent a story
+			if diversity != nil && !ruled.forced && !diversity.allows(channel.Id) {
+				continue
+			}
+			if diversity != nil && !ruled.forced {
+				penalty := diversity.penalty(channel.Id)
+				weightedRate *= penalty
+				explanation = explanation.withFactor("diversity_penalty", penalty)
+			}
+			if weightedRate <= 0 && !ruled.forced {
+				continue
+			}
+			ranked = append(ranked, Selection{
+				ruled.Publication,
+				SuggestionRate(weightedRate),
+				channel,
+				ruled.applied,
+				ruled.forced,
+				explanation,
+			})
 		}
-		if suggestionRate < suggestionRateThreshold {
-			continue
+	}
+
+	if !s.Stories.isEmpty() {
+		ranked = s.Stories.collapse(ranked, s.Stories.cluster(candidates, ranked), exists)
+	}
+
+	sort.SliceStable(ranked, func(i, j int) bool {
+		if ranked[i].Forced != ranked[j].Forced {
+			return ranked[i].Forced
 		}
-		if float64(suggestionRate) > maxSuggestionRate {
-			maxSuggestionRate = float64(suggestionRate)
-			selectedPublication = msg
+		if ranked[i].Channel.Priority != ranked[j].Channel.Priority {
+			return ranked[i].Channel.Priority > ranked[j].Channel.Priority
 		}
+		if ranked[i].Rate != ranked[j].Rate {
+			return ranked[i].Rate > ranked[j].Rate
+		}
+		// map iteration order is random, this keeps ties stable
+		return ranked[i].Publication.Id < ranked[j].Publication.Id
+	})
+
+	if diversity == nil {
+		return ranked
 	}
-	if maxSuggestionRate == 0 {
-		return Publication{}, SuggestionRate(0), ErrExhausted
+	admitted := make([]Selection, 0, len(ranked))
+	for _, selection := range ranked {
+		if selection.Forced {
+			diversity.count(selection.Channel.Id)
+			admitted = append(admitted, selection)
+		} else if diversity.admit(selection.Channel.Id) {
+			admitted = append(admitted, selection)
+		}
 	}
-
-	return selectedPublication, SuggestionRate(maxSuggestionRate), nil
+	return admitted
 }
@@ -0,0 +1,173 @@
+package domain
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// viewsSelector rates publications by their view amount
+type viewsSelector struct{}
+
+func (s viewsSelector) SelectPublication(publications []Publication) (Publication, SuggestionRate) {
+	return topRated(s.RankPublications(publications))
+}
+
+func (s viewsSelector) RankPublications(publications []Publication) []RatedPublication {
+	rated := make([]RatedPublication, len(publications))
+	for k, publication := range publications {
+		rated[k] = RatedPublication{Publication: publication, Rate: SuggestionRate(publication.ViewAmount)}
+	}
+	return sortByRate(rated)
+}
+
+func notExists(Publication) bool { return false }
+
+func TestGlobalSelectorChannelPreferences(t *testing.T) {
+	t.Parallel()
+	postedAt := time.Unix(1661773286, 0)
+
+	meme := NewChannel("meme")
+	outlet := NewChannel("outlet")
+	outlet.Weight = 1.5
+	candidates := map[Channel][]Publication{
+		meme:   {NewPublication("meme/1", 10, postedAt)},
+		outlet: {NewPublication("outlet/1", 10, postedAt)},
+	}
+	selected, rate, err := NewGlobalSelector(viewsSelector{}).SelectPublication(candidates, notExists)
+	if err != nil || selected.Id != "outlet/1" || rate != 15 {
+		t.Errorf("Expected weighted channel to win with rate 15, got %s with %f (%v)", selected.Id, rate, err)
+	}
+
+	tier := NewChannel("tier")
+	tier.Priority = 1
+	candidates[tier] = []Publication{NewPublication("tier/1", 5, postedAt)}
+	selected, _, _ = NewGlobalSelector(viewsSelector{}).SelectPublication(candidates, notExists)
+	if selected.Id != "tier/1" {
+		t.Errorf("Expected higher priority tier to win, got %s", selected.Id)
+	}
+
+	picky := NewChannel("picky")
+	picky.MinRate = 20
+	_, _, err = NewGlobalSelector(viewsSelector{}).SelectPublication(
+		map[Channel][]Publication{picky: {NewPublication("picky/1", 10, postedAt)}},
+		notExists,
+	)
+	if err != ErrExhausted {
+		t.Errorf("Expected publication below channel min rate to be skipped, got %v", err)
+	}
+
+	selector := NewGlobalSelector(viewsSelector{})
+	selector.Threshold = 20
+	selector.Channels = map[string]ChannelSelection{"meme": {viewsSelector{}, 5}}
+	selected, _, _ = selector.SelectPublication(
+		map[Channel][]Publication{meme: candidates[meme], outlet: candidates[outlet]},
+		notExists,
+	)
+	if selected.Id != "meme/1" {
+		t.Errorf("Expected channel threshold to override the global one, got %s", selected.Id)
+	}
+}
+
+func TestGlobalSelectorLimits(t *testing.T) {
+	t.Parallel()
+	postedAt := time.Unix(1661773286, 0)
+	candidates := map[Channel][]Publication{
+		NewChannel("a"): {
+			NewPublication("a/1", 50, postedAt),
+			NewPublication("a/2", 9, postedAt),
+			NewPublication("a/3", 2, postedAt),
+		},
+		NewChannel("b"): {
+			NewPublication("b/1", 10, postedAt),
+			NewPublication("b/2", 8, postedAt),
+		},
+	}
+
+	type table struct {
+		limit SelectionLimit
+		want  []PublicationId
+	}
+	tables := []table{
+		{limit: SelectionLimit{}, want: []PublicationId{"a/1"}},
+		{limit: SelectionLimit{Mode: SelectionModeTop, N: 3}, want: []PublicationId{"a/1", "b/1", "a/2"}},
+		{limit: SelectionLimit{Mode: SelectionModeThreshold, Threshold: 9}, want: []PublicationId{"a/1", "b/1", "a/2"}},
+		{limit: SelectionLimit{Mode: SelectionModeThreshold, Threshold: 9, N: 2}, want: []PublicationId{"a/1", "b/1"}},
+		{limit: SelectionLimit{Mode: SelectionModeDynamic, Deviations: 1}, want: []PublicationId{"a/1"}},
+		{limit: SelectionLimit{Mode: SelectionModeDynamic, Deviations: -1}, want: []PublicationId{"a/1", "b/1", "a/2", "b/2"}},
+	}
+
+	for _, test := range tables {
+		selector := NewGlobalSelector(viewsSelector{})
+		selector.Limit = test.limit
+		selections, err := selector.SelectPublications(candidates, notExists)
+		if err != nil {
+			t.Errorf("SelectPublications() threw an error on limit %+v: %s", test.limit, err)
+			continue
+		}
+		ids := make([]PublicationId, len(selections))
+		for k, selection := range selections {
+			ids[k] = selection.Publication.Id
+		}
+		if !reflect.DeepEqual(ids, test.want) {
+			t.Errorf("Selected incorrectly on limit %+v, got: %v, want: %v.", test.limit, ids, test.want)
+		}
+	}
+}
+
+type historyStub map[string][]time.Time
+
+func (h historyStub) RepostTimesOfChannel(channelId string, since time.Time) []time.Time {
+	var repostTimes []time.Time
+	for _, repostedAt := range h[channelId] {
+		if !repostedAt.Before(since) {
+			repostTimes = append(repostTimes, repostedAt)
+		}
+	}
+	return repostTimes
+}
+
+func TestGlobalSelectorDiversity(t *testing.T) {
+	t.Parallel()
+	currentTime := time.Unix(1661773286, 0)
+
+	candidates := map[Channel][]Publication{
+		NewChannel("viral"): {
+			NewPublication("viral/1", 100, currentTime),
+			NewPublication("viral/2", 90, currentTime),
+			NewPublication("viral/3", 80, currentTime),
+		},
+		NewChannel("calm"): {
+			NewPublication("calm/1", 60, currentTime),
+		},
+	}
+	history := historyStub{"viral": {currentTime.Add(-3 * time.Hour)}}
+
+	type table struct {
+		rules DiversityRules
+		want  []PublicationId
+	}
+	tables := []table{
+		{rules: DiversityRules{}, want: []PublicationId{"viral/1", "viral/2", "viral/3", "calm/1"}},
+		{rules: DiversityRules{MaxPerWindow: 2, Window: 24 * time.Hour}, want: []PublicationId{"viral/1", "calm/1"}},
+		{rules: DiversityRules{MinGap: 2 * time.Hour}, want: []PublicationId{"viral/1", "calm/1"}},
+		{rules: DiversityRules{MinGap: 4 * time.Hour}, want: []PublicationId{"calm/1"}},
+		{rules: DiversityRules{PenaltyFactor: 0.5, PenaltyWindow: 6 * time.Hour}, want: []PublicationId{"calm/1", "viral/1", "viral/2", "viral/3"}},
+	}
+
+	for _, test := range tables {
+		selector := NewGlobalSelector(viewsSelector{})
+		selector.Limit = SelectionLimit{Mode: SelectionModeTop, N: 10}
+		selector.Diversity = test.rules
+		selector.History = history
+		selector.Clock = func() time.Time { return currentTime }
+		selections, _ := selector.SelectPublications(candidates, notExists)
+		ids := make([]PublicationId, len(selections))
+		for k, selection := range selections {
+			ids[k] = selection.Publication.Id
+		}
+		if !reflect.DeepEqual(ids, test.want) {
+			t.Errorf("Selected incorrectly on rules %+v, got: %v, want: %v.", test.rules, ids, test.want)
+		}
+	}
+}
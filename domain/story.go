@@ -0,0 +1,285 @@
+package domain
+
+import (
+	"hash/fnv"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// number of hash functions of MinHash, the error of the similarity estimate is about 1/sqrt(storyHashes)
+const storyHashes = 64
+
+// number of consecutive words a shingle is made of
+const shingleSize = 3
+
+// shorter texts like "Видео" or "Подписаться" are boilerplate rather than stories, they are never duplicates of anything
+const minStoryWords = 8
+
+// StorySignature is a MinHash of word shingles and links of a publication,
+// the share of matching positions of two signatures estimates Jaccard similarity of their contents
+type StorySignature []uint64
+
+// NewStorySignature returns nil for publications of fewer than minStoryWords words, those are never duplicates of anything.
+// Links to the channel itself are left out, as channels put them under every publication
+func NewStorySignature(publication Publication) StorySignature {
+	shingles := storyShingles(publication)
+	if len(shingles) == 0 {
+		return nil
+	}
+	signature := make(StorySignature, storyHashes)
+	for k := range signature {
+		signature[k] = ^uint64(0)
+	}
+	for _, shingle := range shingles {
+		hash := fnv.New64a()
+		_, _ = hash.Write([]byte(shingle))
+		base := hash.Sum64()
+		for k := range signature {
+			if h := mix64(base ^ uint64(k+1)*0x9e3779b97f4a7c15); h < signature[k] {
+				signature[k] = h
+			}
+		}
+	}
+	return signature
+}
+
+// mix64 is a finalizer of splitmix64, it turns a single hash into as many independent ones as there are seeds
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+func storyShingles(publication Publication) []string {
+	words := strings.FieldsFunc(strings.ToLower(publication.Content.Text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	if len(words) < minStoryWords {
+		return nil
+	}
+	var shingles []string
+	for k := 0; k+shingleSize <= len(words); k++ {
+		shingles = append(shingles, strings.Join(words[k:k+shingleSize], " "))
+	}
+	ownLink := "t.me/" + strings.ToLower(publication.ChannelId)
+	for _, link := range publication.Content.Links {
+		link = normalizeLink(link)
+		if publication.ChannelId != "" && (link == ownLink || strings.HasPrefix(link, ownLink+"/") || strings.HasPrefix(link, ownLink+"?")) {
+			continue
+		}
+		shingles = append(shingles, "link:"+link)
+	}
+	return shingles
+}
+
+// normalizeLink makes the same page linked in different ways look alike
+func normalizeLink(link string) string {
+	link = strings.ToLower(link)
+	for _, prefix := range []string{"https://", "http://", "www."} {
+		link = strings.TrimPrefix(link, prefix)
+	}
+	return strings.TrimSuffix(link, "/")
+}
+
+// signatures are split into bands of that many hashes for locality-sensitive hashing. Signatures of similarity s
+// match entirely in at least one of the bands with probability 1-(1-s^rows)^bands, e.g. 0.95 for 0.3 and almost 1 for 0.5
+const storyBandRows = 2
+
+// Bands are keys of LSH buckets the signature falls into. Signatures of the same story share at least one of them
+// with high probability, so that only those sharing a bucket need to be compared
+func (s StorySignature) Bands() []uint64 {
+	bands := make([]uint64, 0, len(s)/storyBandRows)
+	for k := 0; k+storyBandRows <= len(s); k += storyBandRows {
+		// band index is mixed in, so that equal hashes at different positions don't collide
+		band := uint64(k/storyBandRows+1) * 0x9e3779b97f4a7c15
+		for _, h := range s[k : k+storyBandRows] {
+			band = mix64(band ^ h)
+		}
+		bands = append(bands, band)
+	}
+	return bands
+}
+
+// Similarity estimates the share of shingles the two contents have in common
+func (s StorySignature) Similarity(other StorySignature) float64 {
+	if len(s) == 0 || len(s) != len(other) {
+		return 0
+	}
+	var matches int
+	for k := range s {
+		if s[k] == other[k] {
+			matches++
+		}
+	}
+	return float64(matches) / float64(len(s))
+}
+
+type StoryRepresentative string
+
+const (
+	// the copy posted first is likely the original source
+	StoryRepresentativeEarliest   StoryRepresentative = "earliest"
+	StoryRepresentativeMostViewed StoryRepresentative = "most_viewed"
+)
+
+// StoryRules group near-duplicate publications of all channels into stories, so that a story is selected once.
+// Zero value doesn't group anything
+type StoryRules struct {
+	// publications of at least that similarity of text and links are the same story, from 0 to 1
+	Similarity     float64
+	Representative StoryRepresentative
+}
+
+func (r StoryRules) isEmpty() bool {
+	return r.Similarity <= 0
+}
+
+// SameStory tells whether the two signatures belong to the same story
+func (r StoryRules) SameStory(a, b StorySignature) bool {
+	return !r.isEmpty() && a.Similarity(b) >= r.Similarity
+}
+
+// story is a cluster of near-duplicate publications represented by one of them
+type story struct {
+	representative Publication
+	channel        Channel
+	// copies that can't be selected themselves, e.g. excluded by rules or below the threshold.
+	// They never represent the story, but tell whether it has been reposted
+	ineligible []Publication
+}
+
+// reposted tells whether any copy of the story has been reposted, eligible copies are known not to be
+func (s *story) reposted(exists func(publication Publication) bool) bool {
+	for _, publication := range s.ineligible {
+		if exists(publication) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r StoryRules) precedes(a, b Publication) bool {
+	if r.Representative == StoryRepresentativeMostViewed && a.ViewAmount != b.ViewAmount {
+		return a.ViewAmount > b.ViewAmount
+	}
+	if !a.PostedAt.Equal(b.PostedAt) {
+		return a.PostedAt.Before(b.PostedAt)
+	}
+	return a.Id < b.Id
+}
+
+// cluster links every candidate publication to its story. Representatives are picked out of eligible publications only,
+// those which passed rules, thresholds and diversity rules
+func (r StoryRules) cluster(candidates map[Channel][]Publication, eligible []Selection) map[PublicationId]*story {
+	isEligible := make(map[PublicationId]bool, len(eligible))
+	for _, selection := range eligible {
+		isEligible[selection.Publication.Id] = true
+	}
+	type member struct {
+		publication Publication
+		channel     Channel
+		signature   StorySignature
+	}
+	var members []member
+	for channel, publications := range candidates {
+		for _, publication := range publications {
+			members = append(members, member{publication, channel, NewStorySignature(publication)})
+		}
+	}
+	// map iteration order is random, this keeps clusters stable
+	sort.Slice(members, func(i, j int) bool { return members[i].publication.Id < members[j].publication.Id })
+
+	// union-find over similar publications, only those sharing an LSH bucket are compared
+	parents := make([]int, len(members))
+	for k := range parents {
+		parents[k] = k
+	}
+	var root func(k int) int
+	root = func(k int) int {
+		if parents[k] != k {
+			parents[k] = root(parents[k])
+		}
+		return parents[k]
+	}
+	buckets := make(map[uint64][]int)
+	for j, m := range members {
+		for _, band := range m.signature.Bands() {
+			for _, i := range buckets[band] {
+				if root(i) != root(j) && r.SameStory(members[i].signature, m.signature) {
+					parents[root(j)] = root(i)
+				}
+			}
+			buckets[band] = append(buckets[band], j)
+		}
+	}
+
+	stories := make(map[int]*story)
+	for k, m := range members {
+		s, found := stories[root(k)]
+		if !found {
+			s = &story{}
+			stories[root(k)] = s
+		}
+		if !isEligible[m.publication.Id] {
+			s.ineligible = append(s.ineligible, m.publication)
+			continue
+		}
+		if s.representative.Id == "" || r.precedes(m.publication, s.representative) {
+			s.representative, s.channel = m.publication, m.channel
+		}
+	}
+	storyOf := make(map[PublicationId]*story, len(members))
+	for k, m := range members {
+		storyOf[m.publication.Id] = stories[root(k)]
+	}
+	return storyOf
+}
+
+// collapse leaves a single selection per story made of its representative and the best trending copy:
+// rate, rules and explanation are all taken from the copy that would rank first, forced copies going before others
+func (r StoryRules) collapse(
+	selections []Selection,
+	storyOf map[PublicationId]*story,
+	exists func(publication Publication) bool,
+) []Selection {
+	// selections come in map iteration order, so copies are ordered to keep the choice of the best one stable
+	ordered := append([]Selection(nil), selections...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		if ordered[i].Forced != ordered[j].Forced {
+			return ordered[i].Forced
+		}
+		if ordered[i].Rate != ordered[j].Rate {
+			return ordered[i].Rate > ordered[j].Rate
+		}
+		return ordered[i].Publication.Id < ordered[j].Publication.Id
+	})
+
+	var (
+		collapsed []Selection
+		seen      = make(map[*story]bool)
+	)
+	for _, selection := range ordered {
+		s := storyOf[selection.Publication.Id]
+		if s == nil {
+			collapsed = append(collapsed, selection)
+			continue
+		}
+		if seen[s] {
+			continue
+		}
+		seen[s] = true
+		if s.reposted(exists) {
+			continue
+		}
+		if s.representative.Id != selection.Publication.Id {
+			selection.Explanation.RatedPublicationId = selection.Publication.Id
+		}
+		selection.Publication, selection.Channel = s.representative, s.channel
+		collapsed = append(collapsed, selection)
+	}
+	return collapsed
+}
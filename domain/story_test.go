@@ -0,0 +1,179 @@
+package domain
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStorySignatureSimilarity(t *testing.T) {
+	t.Parallel()
+
+	original := Content{
+		Text:  "The central bank raised the key rate to 12 percent at an unscheduled meeting on Tuesday morning",
+		Links: []string{"https://example.com/news/key-rate"},
+	}
+	copied := Content{
+		Text:  "⚡️ The central bank raised the key rate to 12 percent at an unscheduled meeting on Tuesday",
+		Links: []string{"http://www.example.com/news/key-rate/"},
+	}
+	unrelated := Content{Text: "Heavy snowfall is expected in the capital over the weekend, the weather service warns"}
+
+	if similarity := NewStorySignature(Publication{Content: original}).Similarity(NewStorySignature(Publication{Content: copied})); similarity < 0.6 {
+		t.Errorf("Expected copies of the story to be similar, got %f", similarity)
+	}
+	if similarity := NewStorySignature(Publication{Content: original}).Similarity(NewStorySignature(Publication{Content: unrelated})); similarity > 0.1 {
+		t.Errorf("Expected unrelated publications not to be similar, got %f", similarity)
+	}
+	if NewStorySignature(Publication{Content: Content{}}).Similarity(NewStorySignature(Publication{Content: Content{}})) != 0 {
+		t.Errorf("Publications without text and links must never be duplicates")
+	}
+}
+
+func TestStorySignatureBands(t *testing.T) {
+	t.Parallel()
+
+	original := NewStorySignature(Publication{Content: Content{Text: "The central bank raised the key rate to 12 percent at an unscheduled meeting on Tuesday morning"}})
+	copied := NewStorySignature(Publication{Content: Content{Text: "⚡️ The central bank raised the key rate to 12 percent at an unscheduled meeting on Tuesday"}})
+	unrelated := NewStorySignature(Publication{Content: Content{Text: "Heavy snowfall is expected in the capital over the weekend, the weather service warns"}})
+
+	shared := func(a, b StorySignature) int {
+		bands := make(map[uint64]bool)
+		for _, band := range a.Bands() {
+			bands[band] = true
+		}
+		var count int
+		for _, band := range b.Bands() {
+			if bands[band] {
+				count++
+			}
+		}
+		return count
+	}
+	if len(original.Bands()) != storyHashes/storyBandRows {
+		t.Errorf("Expected %d bands, got %d", storyHashes/storyBandRows, len(original.Bands()))
+	}
+	if shared(original, copied) == 0 {
+		t.Errorf("Expected copies of the story to share an LSH bucket")
+	}
+	if shared(original, unrelated) != 0 {
+		t.Errorf("Expected unrelated publications not to share LSH buckets")
+	}
+	if len(NewStorySignature(Publication{Content: Content{}}).Bands()) != 0 {
+		t.Errorf("Publications without text and links must not fall into any bucket")
+	}
+}
+
+func TestGlobalSelectorCollapsesStories(t *testing.T) {
+	t.Parallel()
+	postedAt := time.Unix(1661773286, 0)
+	news := Content{Text: "The central bank raised the key rate to 12 percent at an unscheduled meeting on Tuesday morning"}
+
+	source := NewChannel("source")
+	aggregator := NewChannel("aggregator")
+	original := NewPublication("source/1", 10, postedAt)
+	original.Content = news
+	copied := NewPublication("aggregator/1", 30, postedAt.Add(10*time.Minute))
+	copied.Content = news
+	other := NewPublication("aggregator/2", 20, postedAt)
+	other.Content = Content{Text: "Heavy snowfall is expected in the capital over the weekend"}
+	candidates := map[Channel][]Publication{
+		source:     {original},
+		aggregator: {copied, other},
+	}
+
+	type table struct {
+		representative StoryRepresentative
+		expected       PublicationId
+		// empty if the representative itself gave the rate
+		ratedBy PublicationId
+	}
+	for _, expectation := range []table{
+		{StoryRepresentativeEarliest, "source/1", "aggregator/1"},
+		{StoryRepresentativeMostViewed, "aggregator/1", ""},
+	} {
+		selector := NewGlobalSelector(viewsSelector{})
+		selector.Threshold = 0
+		selector.Stories = StoryRules{Similarity: 0.5, Representative: expectation.representative}
+		selector.Limit = SelectionLimit{Mode: SelectionModeTop, N: 10}
+		selections, _ := selector.SelectPublications(candidates, notExists)
+		if len(selections) != 2 {
+			t.Fatalf("Expected the story and the other publication to be selected, got %d selections", len(selections))
+		}
+		if selections[0].Publication.Id != expectation.expected || selections[0].Rate != 30 {
+			t.Errorf(
+				"Expected %s to represent the story with the best rate of 30, got %s with %f",
+				expectation.expected,
+				selections[0].Publication.Id,
+				selections[0].Rate,
+			)
+		}
+		if explanation := selections[0].Explanation; explanation.LocalRate != 30 || explanation.RatedPublicationId != expectation.ratedBy {
+			t.Errorf(
+				"Expected the explanation of %s with the local rate of 30, got %s with %f",
+				expectation.ratedBy,
+				explanation.RatedPublicationId,
+				explanation.LocalRate,
+			)
+		}
+	}
+
+	selector := NewGlobalSelector(viewsSelector{})
+	selector.Threshold = 0
+	selector.Stories = StoryRules{Similarity: 0.5, Representative: StoryRepresentativeEarliest}
+	selector.Limit = SelectionLimit{Mode: SelectionModeTop, N: 10}
+	reposted := func(publication Publication) bool { return publication.Id == original.Id }
+	selections, _ := selector.SelectPublications(candidates, reposted)
+	if len(selections) != 1 || selections[0].Publication.Id != "aggregator/2" {
+		t.Errorf("Expected copies of an already reposted story to be skipped, got %v", selections)
+	}
+}
+
+func TestStoryRepresentativePassedRules(t *testing.T) {
+	t.Parallel()
+	postedAt := time.Unix(1661773286, 0)
+	news := "The central bank raised the key rate to 12 percent at an unscheduled meeting on Tuesday morning"
+
+	advertiser := NewChannel("advertiser")
+	aggregator := NewChannel("aggregator")
+	ad := NewPublication("advertiser/1", 50, postedAt)
+	ad.Content = Content{Text: news + " #реклама", Hashtags: []string{"#реклама"}}
+	copied := NewPublication("aggregator/1", 30, postedAt.Add(10*time.Minute))
+	copied.Content = Content{Text: news}
+
+	selector := NewGlobalSelector(viewsSelector{})
+	selector.Threshold = 0
+	selector.Stories = StoryRules{Similarity: 0.5, Representative: StoryRepresentativeEarliest}
+	selector.Rules = Rules{{Name: "ads", Hashtags: []string{"реклама"}, Action: RuleActionExclude}}
+	selector.Limit = SelectionLimit{Mode: SelectionModeTop, N: 10}
+	selections, _ := selector.SelectPublications(map[Channel][]Publication{
+		advertiser: {ad},
+		aggregator: {copied},
+	}, notExists)
+	if len(selections) != 1 || selections[0].Publication.Id != copied.Id || selections[0].Channel.Id != aggregator.Id {
+		t.Errorf("Expected the copy that passed rules to represent the story instead of the earlier excluded one, got %v", selections)
+	}
+}
+
+func TestShortPublicationsAreNotStories(t *testing.T) {
+	t.Parallel()
+	rules := StoryRules{Similarity: 0.5}
+
+	video := Publication{ChannelId: "mash", Content: Content{Text: "Видео"}}
+	otherVideo := Publication{ChannelId: "mash", Content: Content{Text: "видео!"}}
+	if signature := NewStorySignature(video); signature != nil || rules.SameStory(signature, NewStorySignature(otherVideo)) {
+		t.Errorf("Expected distinct short captions not to make up a story, got signature %v", signature)
+	}
+
+	// channels sign every publication with a link to themselves
+	subscribe := Publication{ChannelId: "mash", Content: Content{
+		Text:  "Мэр открыл новую станцию метро на юге города после трёх лет стройки. Подписаться",
+		Links: []string{"https://t.me/mash"},
+	}}
+	otherSubscribe := Publication{ChannelId: "mash", Content: Content{
+		Text:  "Синоптики обещают аномальную жару до конца недели во всех регионах страны. Подписаться",
+		Links: []string{"https://t.me/mash", "t.me/Mash/12345"},
+	}}
+	if similarity := NewStorySignature(subscribe).Similarity(NewStorySignature(otherSubscribe)); similarity != 0 {
+		t.Errorf("Expected links of the channel to itself not to count, got similarity of %f", similarity)
+	}
+}
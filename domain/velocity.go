@@ -0,0 +1,130 @@
+package domain
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"math"
+	"time"
+)
+
+type VelocityParams struct {
+	// views of the freshest publications are too noisy to be compared to anything
+	MinAge time.Duration
+	// fitting a curve through fewer publications makes little sense
+	MinSample int
+}
+
+func DefaultVelocityParams() VelocityParams {
+	return VelocityParams{MinAge: 5 * time.Minute, MinSample: 5}
+}
+
+func (p VelocityParams) Validate() error {
+	if p.MinAge < 0 {
+		return fmt.Errorf("min age can't be negative, got %s", p.MinAge)
+	}
+	// the curve is fitted without the publication being rated, so at least 2 others are needed
+	if p.MinSample < 3 {
+		return fmt.Errorf("min sample must be at least 3, got %d", p.MinSample)
+	}
+	return nil
+}
+
+// velocityLocalSelector scores publications by how their views exceed what the channel usually gets at the same age.
+// The expected views-by-age curve views = k * age^b is fitted through the channel's other publications in log-log scale
+type velocityLocalSelector struct {
+	params VelocityParams
+	// ages are counted up to the moment it tells, e.g. a simulated one when replaying history
+	clock func() time.Time
+}
+
+func NewVelocityLocalSelector(params VelocityParams, clock func() time.Time) *velocityLocalSelector {
+	return &velocityLocalSelector{params, clock}
+}
+
+type viewsByAgeCurve struct {
+	logK float64
+	b    float64
+}
+
+func (c viewsByAgeCurve) expectedViews(ageMinutes float64) float64 {
+	return math.Exp(c.logK+c.b*math.Log(ageMinutes)) - 1
+}
+
+// curveSums accumulates least squares sums for log(views+1) = log(k) + b*log(age)
+type curveSums struct {
+	n, x, y, xx, xy float64
+}
+
+func (s curveSums) with(ageMinutes float64, views int, sign float64) curveSums {
+	x := math.Log(ageMinutes)
+	y := math.Log(float64(views) + 1)
+	return curveSums{s.n + sign, s.x + sign*x, s.y + sign*y, s.xx + sign*x*x, s.xy + sign*x*y}
+}
+
+func (s curveSums) fit() viewsByAgeCurve {
+	denominator := s.n*s.xx - s.x*s.x
+	if math.Abs(denominator) < 1e-9 {
+		// all publications are of the same age, so the curve is flat
+		return viewsByAgeCurve{logK: s.y / s.n}
+	}
+	b := (s.n*s.xy - s.x*s.y) / denominator
+	// views never decrease with age
+	if b < 0 {
+		b = 0
+	}
+	return viewsByAgeCurve{logK: (s.y - b*s.x) / s.n, b: b}
+}
+
+func (s *velocityLocalSelector) RankPublications(publications []Publication) []RatedPublication {
+	current := s.clock()
+	var (
+		candidates []Publication
+		ages       []float64
+		views      []int
+	)
+	for _, publication := range withKnownViews(publications) {
+		age := current.Sub(publication.PostedAt)
+		if age < s.params.MinAge {
+			continue
+		}
+		candidates = append(candidates, publication)
+		ages = append(ages, age.Minutes())
+		views = append(views, publication.ViewAmount)
+	}
+	if len(candidates) < s.params.MinSample {
+		return nil
+	}
+
+	var sums curveSums
+	for k := range candidates {
+		sums = sums.with(ages[k], views[k], 1)
+	}
+
+	rated := make([]RatedPublication, 0, len(candidates))
+	for k, publication := range candidates {
+		// the curve is fitted without the publication being rated, otherwise an outlier drags the curve up to itself
+		expected := sums.with(ages[k], views[k], -1).fit().expectedViews(ages[k])
+		if expected < 1 {
+			expected = 1
+		}
+		rate := float64(views[k]) / expected
+		log.WithFields(log.Fields{
+			"id":       publication.Id,
+			"rate":     rate,
+			"age":      ages[k],
+			"expected": expected,
+		}).Debug("Rated publication of channel")
+
+		rated = append(rated, RatedPublication{publication, SuggestionRate(rate), Explanation{
+			Selector: "velocity",
+			Inputs:   map[string]float64{"views": float64(views[k]), "age_minutes": ages[k]},
+			Factors:  map[string]float64{"expected_views": expected},
+		}})
+	}
+
+	return sortByRate(rated)
+}
+
+func (s *velocityLocalSelector) SelectPublication(publications []Publication) (Publication, SuggestionRate) {
+	return topRated(s.RankPublications(publications))
+}
@@ -0,0 +1,40 @@
+package domain
+
+import (
+	"math"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestVelocitySelectorPrefersFreshOverperformer(t *testing.T) {
+	t.Parallel()
+	currentTime := time.Unix(1661773286, 0)
+	clock := func() time.Time { return currentTime }
+
+	var publications []Publication
+	// regular publications of the channel, an hour apart, views growing as 100*sqrt(age)
+	for i := 12; i >= 1; i-- {
+		age := time.Duration(i) * time.Hour
+		views := int(100 * math.Sqrt(age.Minutes()))
+		publications = append(publications, NewPublication("tg/"+strconv.Itoa(13-i), views, currentTime.Add(-age)))
+	}
+	// 20 minutes old, already has as many views as a 6 hours old one
+	fresh := NewPublication("tg/fresh", int(100*math.Sqrt(360)), currentTime.Add(-20*time.Minute))
+	publications = append(publications, fresh)
+	// too fresh to be judged
+	publications = append(publications, NewPublication("tg/newest", 5000, currentTime.Add(-time.Minute)))
+
+	selected, rate := NewVelocityLocalSelector(DefaultVelocityParams(), clock).SelectPublication(publications)
+	if selected.Id != fresh.Id {
+		t.Errorf("Expected fresh overperforming publication to be selected, got %s", selected.Id)
+	}
+	if rate < 4 {
+		t.Errorf("Expected rate well above expectations, got %f", rate)
+	}
+
+	_, rate = NewVelocityLocalSelector(DefaultVelocityParams(), clock).SelectPublication(publications[:3])
+	if rate != 0 {
+		t.Errorf("Too few publications must not be rated, got %f", rate)
+	}
+}
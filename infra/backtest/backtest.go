@@ -0,0 +1,163 @@
+package backtest
+
+import (
+	"github.com/alexeyvy/tjlike-agenda/domain"
+	"sort"
+	"time"
+)
+
+// Source is where recorded scrapes come from, e.g. the snapshot store
+type Source interface {
+	Walk(func(publication domain.Publication, samples []domain.ViewSample))
+}
+
+type GlobalSelector interface {
+	SelectPublications(
+		candidates map[domain.Channel][]domain.Publication,
+		exists func(publication domain.Publication) bool,
+	) ([]domain.Selection, error)
+}
+
+// Traversal is what a single scraping pass saw, publications carry view amounts as of that moment
+type Traversal struct {
+	At         time.Time
+	Candidates map[domain.Channel][]domain.Publication
+}
+
+// Traversals restores scraping passes out of recorded samples, as every pass records all of its publications at once.
+// Channels missing from the given ones are treated as default channels
+func Traversals(source Source, channels map[string]domain.Channel) []Traversal {
+	byMoment := make(map[time.Time]map[domain.Channel][]domain.Publication)
+	source.Walk(func(publication domain.Publication, samples []domain.ViewSample) {
+		channel, found := channels[publication.ChannelId]
+		if !found {
+			channel = domain.NewChannel(publication.ChannelId)
+		}
+		for _, sample := range samples {
+			at := sample.ObservedAt.UTC()
+			if byMoment[at] == nil {
+				byMoment[at] = make(map[domain.Channel][]domain.Publication)
+			}
+			observed := publication
+			observed.ViewAmount = sample.ViewAmount
+			byMoment[at][channel] = append(byMoment[at][channel], observed)
+		}
+	})
+
+	traversals := make([]Traversal, 0, len(byMoment))
+	for at, candidates := range byMoment {
+		for _, publications := range candidates {
+			// selectors expect publications in the order of the channel feed
+			sort.Slice(publications, func(i, j int) bool {
+				if !publications[i].PostedAt.Equal(publications[j].PostedAt) {
+					return publications[i].PostedAt.Before(publications[j].PostedAt)
+				}
+				return publications[i].Id < publications[j].Id
+			})
+		}
+		traversals = append(traversals, Traversal{at, candidates})
+	}
+	sort.Slice(traversals, func(i, j int) bool { return traversals[i].At.Before(traversals[j].At) })
+	return traversals
+}
+
+// Repost is what would have been reposted and when
+type Repost struct {
+	At        time.Time
+	Selection domain.Selection
+}
+
+// History stands for the repost storage during replay, so that the selector sees its own earlier picks
+type History struct {
+	stories domain.StoryRules
+	reposts []Repost
+}
+
+func NewHistory(stories domain.StoryRules) *History {
+	return &History{stories: stories}
+}
+
+func (h *History) RepostTimesOfChannel(channelId string, since time.Time) []time.Time {
+	var repostTimes []time.Time
+	for _, repost := range h.reposts {
+		if repost.Selection.Publication.ChannelId == channelId && !repost.At.Before(since) {
+			repostTimes = append(repostTimes, repost.At)
+		}
+	}
+	return repostTimes
+}
+
+func (h *History) ExistsForPublication(publication domain.Publication) bool {
+	signature := domain.NewStorySignature(publication)
+	for _, repost := range h.reposts {
+		reposted := repost.Selection.Publication
+		if reposted.Id == publication.Id || h.stories.SameStory(signature, domain.NewStorySignature(reposted)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Clock is simulated time of a single replay, selectors are meant to tell the current moment by its Now
+type Clock struct {
+	at time.Time
+}
+
+func (c *Clock) Now() time.Time {
+	return c.at
+}
+
+// Run replays the traversals through the selector, the clock is set to the moment of every traversal
+func Run(traversals []Traversal, selector GlobalSelector, history *History, clock *Clock) []Repost {
+	for _, traversal := range traversals {
+		clock.at = traversal.At
+		// selection fails with domain.ErrExhausted only, meaning there is nothing to repost
+		selections, _ := selector.SelectPublications(traversal.Candidates, history.ExistsForPublication)
+		for _, selection := range selections {
+			history.reposts = append(history.reposts, Repost{traversal.At, selection})
+		}
+	}
+	return history.reposts
+}
+
+// Change is a publication reposted by both runs at different moments
+type Change struct {
+	Baseline  Repost
+	Candidate Repost
+}
+
+type Diff struct {
+	OnlyBaseline  []Repost
+	OnlyCandidate []Repost
+	Moved         []Change
+	// number of publications reposted by both runs at the same moment
+	Same int
+}
+
+// Compare tells how reposts of the candidate run differ from the baseline ones
+func Compare(baseline, candidate []Repost) Diff {
+	var diff Diff
+	candidates := make(map[domain.PublicationId]Repost, len(candidate))
+	for _, repost := range candidate {
+		candidates[repost.Selection.Publication.Id] = repost
+	}
+	for _, repost := range baseline {
+		id := repost.Selection.Publication.Id
+		counterpart, found := candidates[id]
+		switch {
+		case !found:
+			diff.OnlyBaseline = append(diff.OnlyBaseline, repost)
+		case !counterpart.At.Equal(repost.At):
+			diff.Moved = append(diff.Moved, Change{repost, counterpart})
+		default:
+			diff.Same++
+		}
+		delete(candidates, id)
+	}
+	for _, repost := range candidate {
+		if _, left := candidates[repost.Selection.Publication.Id]; left {
+			diff.OnlyCandidate = append(diff.OnlyCandidate, repost)
+		}
+	}
+	return diff
+}
@@ -0,0 +1,63 @@
+package backtest
+
+import (
+	"github.com/alexeyvy/tjlike-agenda/domain"
+	"github.com/alexeyvy/tjlike-agenda/infra/snapshot"
+	"testing"
+	"time"
+)
+
+func TestReplayAndCompare(t *testing.T) {
+	postedAt := time.Unix(1661773286, 0).UTC()
+	first, second := postedAt.Add(time.Hour), postedAt.Add(2*time.Hour)
+	publication := func(id string, views int, minutes int) domain.Publication {
+		p := domain.NewPublication(id, views, postedAt.Add(time.Duration(minutes)*time.Minute))
+		p.ChannelId = "news"
+		return p
+	}
+
+	snapshots := snapshot.NewInMemoryStore(snapshot.Retention{})
+	snapshots.Record([]domain.Publication{
+		publication("news/1", 100, 0),
+		publication("news/2", 100, 1),
+		publication("news/3", 100, 2),
+		publication("news/4", 500, 3),
+	}, first)
+	// news/4 keeps trending on the next traversal, while news/5 takes off
+	snapshots.Record([]domain.Publication{
+		publication("news/1", 100, 0),
+		publication("news/2", 100, 1),
+		publication("news/3", 100, 2),
+		publication("news/4", 600, 3),
+		publication("news/5", 6000, 4),
+	}, second)
+
+	traversals := Traversals(snapshots, map[string]domain.Channel{})
+	if len(traversals) != 2 || !traversals[0].At.Equal(first) {
+		t.Fatalf("Expected 2 traversals in chronological order, got %v", traversals)
+	}
+
+	baselineHistory := NewHistory(domain.StoryRules{})
+	baseline := Run(traversals, domain.NewGlobalSelector(domain.NewLocalSelector()), baselineHistory, &Clock{})
+	type table struct {
+		id domain.PublicationId
+		at time.Time
+	}
+	expected := []table{{"news/4", first}, {"news/5", second}}
+	if len(baseline) != len(expected) {
+		t.Fatalf("Expected %d reposts, got %v", len(expected), baseline)
+	}
+	for k, expectation := range expected {
+		if baseline[k].Selection.Publication.Id != expectation.id || !baseline[k].At.Equal(expectation.at) {
+			t.Errorf("Repost %d: got %s at %s, want %s at %s", k, baseline[k].Selection.Publication.Id, baseline[k].At, expectation.id, expectation.at)
+		}
+	}
+
+	strict := domain.NewGlobalSelector(domain.NewLocalSelector())
+	strict.Threshold = 20
+	candidate := Run(traversals, strict, NewHistory(domain.StoryRules{}), &Clock{})
+	diff := Compare(baseline, candidate)
+	if diff.Same != 1 || len(diff.OnlyBaseline) != 1 || diff.OnlyBaseline[0].Selection.Publication.Id != "news/4" || len(diff.OnlyCandidate) != 0 {
+		t.Errorf("Expected stricter threshold to only drop news/4, got %+v", diff)
+	}
+}
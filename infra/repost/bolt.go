@@ -0,0 +1,476 @@
+package repost
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/alexeyvy/tjlike-agenda/domain"
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+	"sync"
+	"time"
+)
+
+var (
+	repostsBucket  = []byte("reposts")
+	channelsBucket = []byte("channels")
+	cursorsBucket  = []byte("cursors")
+	// entries purged before all consumers read them, keyed by their ID
+	deadLettersBucket = []byte("dead_letters")
+	// indexes keyed by publication ID and by reposted-at moment, both followed by the repost ID
+	publicationIndexBucket = []byte("reposts_by_publication")
+	repostedAtIndexBucket  = []byte("reposts_by_reposted_at")
+	// LSH bands of story signatures followed by the repost ID
+	storyIndexBucket = []byte("reposts_by_story_band")
+	// counters kept up to date by the same transactions that change reposts
+	metaBucket = []byte("meta")
+	countKey   = []byte("count")
+)
+
+// BoltStore keeps reposts in an embedded transactional DB, every write is committed on its own so a crash never leaves it half-written
+type BoltStore struct {
+	db *bolt.DB
+	sync.RWMutex
+}
+
+func NewBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("cannot open DB: %w", err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{repostsBucket, channelsBucket, cursorsBucket, deadLettersBucket, publicationIndexBucket, repostedAtIndexBucket, storyIndexBucket, metaBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("cannot create DB buckets: %w", err)
+	}
+	return &BoltStore{db: db}, nil
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
+
+func idKey(id int) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(id))
+	return key
+}
+
+func publicationIndexKey(e *entry) []byte {
+	// publication IDs never contain zero bytes, so the separator keeps prefixes of different IDs apart
+	return append(append([]byte(e.R.Pub.Id), 0), idKey(e.Id)...)
+}
+
+func momentKey(t time.Time) []byte {
+	key := make([]byte, 8)
+	// moments before the epoch don't happen to reposts, they are only used as an open lower bound
+	if t.After(time.Unix(0, 0)) {
+		binary.BigEndian.PutUint64(key, uint64(t.UnixNano()))
+	}
+	return key
+}
+
+func repostedAtIndexKey(e *entry) []byte {
+	return append(momentKey(e.R.RepostedAt), idKey(e.Id)...)
+}
+
+func storyIndexKeys(e *entry) [][]byte {
+	bands := e.story().Bands()
+	keys := make([][]byte, len(bands))
+	for k, band := range bands {
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, band)
+		keys[k] = append(key, idKey(e.Id)...)
+	}
+	return keys
+}
+
+func putStoryIndex(tx *bolt.Tx, e *entry) error {
+	for _, key := range storyIndexKeys(e) {
+		if err := tx.Bucket(storyIndexBucket).Put(key, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *BoltStore) insert(e *entry) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		id, err := tx.Bucket(repostsBucket).NextSequence()
+		if err != nil {
+			return err
+		}
+		e.Id = int(id)
+		if err := putEntry(tx, e); err != nil {
+			return err
+		}
+		return addToCount(tx, 1)
+	})
+}
+
+func addToCount(tx *bolt.Tx, delta int) error {
+	meta := tx.Bucket(metaBucket)
+	var count int64
+	if value := meta.Get(countKey); value != nil {
+		count = int64(binary.BigEndian.Uint64(value))
+	}
+	value := make([]byte, 8)
+	binary.BigEndian.PutUint64(value, uint64(count+int64(delta)))
+	return meta.Put(countKey, value)
+}
+
+func putEntry(tx *bolt.Tx, e *entry) error {
+	encoded, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("cannot marshal repost: %w", err)
+	}
+	if err := tx.Bucket(repostsBucket).Put(idKey(e.Id), encoded); err != nil {
+		return err
+	}
+	if err := tx.Bucket(publicationIndexBucket).Put(publicationIndexKey(e), nil); err != nil {
+		return err
+	}
+	if err := putStoryIndex(tx, e); err != nil {
+		return err
+	}
+	return tx.Bucket(repostedAtIndexBucket).Put(repostedAtIndexKey(e), nil)
+}
+
+func getEntry(tx *bolt.Tx, id []byte) (*entry, error) {
+	value := tx.Bucket(repostsBucket).Get(id)
+	if value == nil {
+		return nil, fmt.Errorf("index refers to missing repost %d", binary.BigEndian.Uint64(id))
+	}
+	var e entry
+	if err := json.Unmarshal(value, &e); err != nil {
+		return nil, fmt.Errorf("cannot unmarshal repost %d: %w", binary.BigEndian.Uint64(id), err)
+	}
+	return &e, nil
+}
+
+func (s *BoltStore) walkAfter(id int, handle func(e *entry) bool) {
+	// entries are decoded in batches, so that handle is free to write in between
+	const batchSize = 100
+	for {
+		var batch []*entry
+		err := s.db.View(func(tx *bolt.Tx) error {
+			cursor := tx.Bucket(repostsBucket).Cursor()
+			for key, value := cursor.Seek(idKey(id + 1)); key != nil && len(batch) < batchSize; key, value = cursor.Next() {
+				var e entry
+				if err := json.Unmarshal(value, &e); err != nil {
+					return fmt.Errorf("cannot unmarshal repost %d: %w", binary.BigEndian.Uint64(key), err)
+				}
+				batch = append(batch, &e)
+			}
+			return nil
+		})
+		if err != nil {
+			log.Errorf("cannot read reposts: %s", err)
+			return
+		}
+		for _, e := range batch {
+			if !handle(e) {
+				return
+			}
+			id = e.Id
+		}
+		if len(batch) < batchSize {
+			return
+		}
+	}
+}
+
+func (s *BoltStore) lastId() int {
+	var id uint64
+	err := s.db.View(func(tx *bolt.Tx) error {
+		id = tx.Bucket(repostsBucket).Sequence()
+		return nil
+	})
+	if err != nil {
+		log.Errorf("cannot read the latest repost ID: %s", err)
+	}
+	return int(id)
+}
+
+func (s *BoltStore) findByPublication(id domain.PublicationId) (*entry, bool) {
+	var found *entry
+	err := s.db.View(func(tx *bolt.Tx) error {
+		prefix := append([]byte(id), 0)
+		cursor := tx.Bucket(publicationIndexBucket).Cursor()
+		var latest []byte
+		for key, _ := cursor.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, _ = cursor.Next() {
+			latest = key[len(prefix):]
+		}
+		if latest == nil {
+			return nil
+		}
+		var err error
+		found, err = getEntry(tx, latest)
+		return err
+	})
+	if err != nil {
+		log.Errorf("cannot look up repost of publication %s: %s", id, err)
+		return nil, false
+	}
+	return found, found != nil
+}
+
+func (s *BoltStore) walkSharingStoryBands(bands []uint64, handle func(e *entry)) {
+	var entries []*entry
+	err := s.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(storyIndexBucket).Cursor()
+		visited := make(map[string]bool)
+		for _, band := range bands {
+			prefix := make([]byte, 8)
+			binary.BigEndian.PutUint64(prefix, band)
+			for key, _ := cursor.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, _ = cursor.Next() {
+				id := key[8:]
+				if visited[string(id)] {
+					continue
+				}
+				visited[string(id)] = true
+				e, err := getEntry(tx, id)
+				if err != nil {
+					return err
+				}
+				entries = append(entries, e)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Errorf("cannot look up reposts of the same story: %s", err)
+	}
+	for _, e := range entries {
+		handle(e)
+	}
+}
+
+func (s *BoltStore) walkRepostedBetween(from, to time.Time, handle func(e *entry)) {
+	var entries []*entry
+	err := s.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(repostedAtIndexBucket).Cursor()
+		upperBound := momentKey(to)
+		for key, _ := cursor.Seek(momentKey(from)); key != nil; key, _ = cursor.Next() {
+			if !to.IsZero() && bytes.Compare(key[:8], upperBound) >= 0 {
+				break
+			}
+			e, err := getEntry(tx, key[8:])
+			if err != nil {
+				return err
+			}
+			entries = append(entries, e)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Errorf("cannot read reposts: %s", err)
+	}
+	for _, e := range entries {
+		handle(e)
+	}
+}
+
+func (s *BoltStore) delete(e entry) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return deleteEntry(tx, &e)
+	})
+}
+
+func deleteEntry(tx *bolt.Tx, e *entry) error {
+	if tx.Bucket(repostsBucket).Get(idKey(e.Id)) == nil {
+		return nil
+	}
+	if err := tx.Bucket(repostsBucket).Delete(idKey(e.Id)); err != nil {
+		return err
+	}
+	if err := addToCount(tx, -1); err != nil {
+		return err
+	}
+	if err := tx.Bucket(publicationIndexBucket).Delete(publicationIndexKey(e)); err != nil {
+		return err
+	}
+	for _, key := range storyIndexKeys(e) {
+		if err := tx.Bucket(storyIndexBucket).Delete(key); err != nil {
+			return err
+		}
+	}
+	return tx.Bucket(repostedAtIndexBucket).Delete(repostedAtIndexKey(e))
+}
+
+func (s *BoltStore) count() int {
+	var n int
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if value := tx.Bucket(metaBucket).Get(countKey); value != nil {
+			n = int(binary.BigEndian.Uint64(value))
+		}
+		return nil
+	})
+	if err != nil {
+		log.Errorf("cannot count reposts: %s", err)
+	}
+	return n
+}
+
+func (s *BoltStore) saveChannel(info domain.ChannelInfo) error {
+	encoded, err := json.Marshal(info)
+	if err != nil {
+		return fmt.Errorf("cannot marshal channel: %w", err)
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(channelsBucket).Put([]byte(info.Id), encoded)
+	})
+}
+
+func (s *BoltStore) findChannel(id string) (domain.ChannelInfo, bool) {
+	var (
+		info  domain.ChannelInfo
+		found bool
+	)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(channelsBucket).Get([]byte(id))
+		if value == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(value, &info)
+	})
+	if err != nil {
+		log.Errorf("cannot read channel %s: %s", id, err)
+		return domain.ChannelInfo{}, false
+	}
+	return info, found
+}
+
+func (s *BoltStore) saveCursor(consumer string, id int) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(cursorsBucket).Put([]byte(consumer), idKey(id))
+	})
+}
+
+func (s *BoltStore) deleteCursor(consumer string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(cursorsBucket).Delete([]byte(consumer))
+	})
+}
+
+func (s *BoltStore) findCursors() map[string]int {
+	cursors := make(map[string]int)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(cursorsBucket).ForEach(func(consumer, id []byte) error {
+			cursors[string(consumer)] = int(binary.BigEndian.Uint64(id))
+			return nil
+		})
+	})
+	if err != nil {
+		log.Errorf("cannot read consumer cursors: %s", err)
+	}
+	return cursors
+}
+
+// moveToDeadLetters deletes the entry and keeps it as a dead letter in a single transaction
+func (s *BoltStore) moveToDeadLetters(e entry) error {
+	encoded, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("cannot marshal repost: %w", err)
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := deleteEntry(tx, &e); err != nil {
+			return err
+		}
+		return tx.Bucket(deadLettersBucket).Put(idKey(e.Id), encoded)
+	})
+}
+
+func (s *BoltStore) deleteDeadLetter(id int) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(deadLettersBucket).Delete(idKey(id))
+	})
+}
+
+func (s *BoltStore) walkDeadLetters(handle func(e *entry)) {
+	var entries []*entry
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(deadLettersBucket).ForEach(func(key, value []byte) error {
+			var e entry
+			if err := json.Unmarshal(value, &e); err != nil {
+				return fmt.Errorf("cannot unmarshal dead letter %d: %w", binary.BigEndian.Uint64(key), err)
+			}
+			entries = append(entries, &e)
+			return nil
+		})
+	})
+	if err != nil {
+		log.Errorf("cannot read dead letters: %s", err)
+	}
+	for _, e := range entries {
+		handle(e)
+	}
+}
+
+// ImportFileStore fills the DB with everything the JSON one keeps, so that switching the engine doesn't lose history,
+// read state or channels. It only imports into a DB that has never been written to and tells whether it did
+func (s *BoltStore) ImportFileStore(fs *FileStore) (bool, error) {
+	var written bool
+	err := s.db.View(func(tx *bolt.Tx) error {
+		written = tx.Bucket(repostsBucket).Sequence() > 0 || tx.Bucket(channelsBucket).Stats().KeyN > 0
+		return nil
+	})
+	if err != nil || written {
+		return false, err
+	}
+	if err := fs.Pull(); err != nil {
+		if err == ErrDBNotInited {
+			return false, nil
+		}
+		return false, err
+	}
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		reposts := tx.Bucket(repostsBucket)
+		for _, e := range fs.entries {
+			if err := putEntry(tx, e); err != nil {
+				return err
+			}
+		}
+		if err := addToCount(tx, len(fs.entries)); err != nil {
+			return err
+		}
+		// IDs go on from where the JSON DB stopped, so that cursors stay valid
+		if err := reposts.SetSequence(uint64(fs.nextId - 1)); err != nil {
+			return err
+		}
+		for _, info := range fs.channels {
+			encoded, err := json.Marshal(info)
+			if err != nil {
+				return fmt.Errorf("cannot marshal channel: %w", err)
+			}
+			if err := tx.Bucket(channelsBucket).Put([]byte(info.Id), encoded); err != nil {
+				return err
+			}
+		}
+		for consumer, id := range fs.cursors {
+			if err := tx.Bucket(cursorsBucket).Put([]byte(consumer), idKey(id)); err != nil {
+				return err
+			}
+		}
+		for _, e := range fs.deadLetters {
+			encoded, err := json.Marshal(e)
+			if err != nil {
+				return fmt.Errorf("cannot marshal repost: %w", err)
+			}
+			if err := tx.Bucket(deadLettersBucket).Put(idKey(e.Id), encoded); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return err == nil, err
+}
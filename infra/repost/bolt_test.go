@@ -0,0 +1,131 @@
+package repost
+
+import (
+	"github.com/alexeyvy/tjlike-agenda/domain"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBoltStoreSurvivesReopening(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "reposts.db")
+
+	store, err := NewBoltStore(path)
+	if err != nil {
+		t.Fatalf("NewBoltStore() threw an error: %v", err)
+	}
+	s := NewService(store, domain.StoryRules{})
+	_ = s.Register(DefaultConsumer)
+	info := domain.NewChannelInfo("platform")
+	info.Title = "Platform channel"
+	_ = s.UpdateChannel(info)
+	publication := domain.NewPublication("platform/id", 10300, time.Now())
+	publication.ChannelId = "platform"
+	_, _ = s.RepostSelection(domain.Selection{Publication: publication, Rate: domain.SuggestionRate(5)})
+	_, _ = s.RepostSelection(domain.Selection{Publication: domain.NewPublication("platform/id2", 10300, time.Now()), Rate: domain.SuggestionRate(5)})
+	if reposts, _ := s.PickUp(DefaultConsumer, 0, true); len(reposts) != 2 {
+		t.Errorf("Expected 2 reposts to be picked up, got %d", len(reposts))
+	}
+	_, _ = s.RepostSelection(domain.Selection{Publication: domain.NewPublication("platform/id3", 10300, time.Now()), Rate: domain.SuggestionRate(5)})
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close() threw an error: %v", err)
+	}
+
+	store, err = NewBoltStore(path)
+	if err != nil {
+		t.Fatalf("NewBoltStore() threw an error on reopening: %v", err)
+	}
+	defer store.Close()
+	s = NewService(store, domain.StoryRules{})
+	_ = s.Register(DefaultConsumer)
+	if !s.ExistsForPublication(publication) {
+		t.Errorf("Expected repost to survive reopening")
+	}
+	if channel, found := store.findChannel("platform"); !found || channel != info {
+		t.Errorf("Expected channel info %+v to survive reopening, got %+v", info, channel)
+	}
+	reposts, _ := s.PickUp(DefaultConsumer, 0, true)
+	if len(reposts) != 1 || reposts[0].Pub.Id != "platform/id3" {
+		t.Errorf("Expected only the repost that wasn't retrieved before reopening, got %v", reposts)
+	}
+}
+
+func TestBoltStoreIdSequenceAndDeletion(t *testing.T) {
+	t.Parallel()
+
+	store, err := NewBoltStore(filepath.Join(t.TempDir(), "reposts.db"))
+	if err != nil {
+		t.Fatalf("NewBoltStore() threw an error: %v", err)
+	}
+	defer store.Close()
+
+	e1 := entry{
+		R: domain.NewRepost(domain.NewPublication("platform/id", 10300, time.Now()), time.Now(), domain.SuggestionRate(5)),
+	}
+	e2 := entry{
+		R: domain.NewRepost(domain.NewPublication("platform/id2", 10300, time.Now()), time.Now(), domain.SuggestionRate(5)),
+	}
+	_ = store.insert(&e1)
+	_ = store.insert(&e2)
+	if e1.Id != 1 || e2.Id != 2 {
+		t.Errorf("Expected sequential IDs 1 and 2, got %d and %d", e1.Id, e2.Id)
+	}
+
+	if err := store.delete(e1); err != nil {
+		t.Errorf("delete() threw an error: %v", err)
+	}
+	var entries []entry
+	store.walkAfter(0, func(e *entry) bool {
+		entries = append(entries, *e)
+		return true
+	})
+	if len(entries) != 1 || entries[0].Id != e2.Id {
+		t.Errorf("Expected only the second entry left, got %v", entries)
+	}
+}
+
+func TestBoltStoreImportsFileStore(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+
+	fileStore := NewFileStore(filepath.Join(dir, "reposts.txt"))
+	s := NewService(fileStore, domain.StoryRules{})
+	_ = s.Register(DefaultConsumer)
+	info := domain.NewChannelInfo("platform")
+	info.Title = "Platform channel"
+	_ = s.UpdateChannel(info)
+	first, _ := s.RepostSelection(domain.Selection{Publication: domain.NewPublication("platform/id", 10300, time.Now()), Rate: domain.SuggestionRate(5)})
+	_, _ = s.RepostSelection(domain.Selection{Publication: domain.NewPublication("platform/id2", 10300, time.Now()), Rate: domain.SuggestionRate(5)})
+	_ = s.Register("bot")
+	_ = s.Ack("bot", first.Id)
+
+	store, err := NewBoltStore(filepath.Join(dir, "reposts.db"))
+	if err != nil {
+		t.Fatalf("NewBoltStore() threw an error: %v", err)
+	}
+	defer store.Close()
+	if imported, err := store.ImportFileStore(NewFileStore(filepath.Join(dir, "reposts.txt"))); !imported || err != nil {
+		t.Fatalf("Expected the file store to be imported, got %t (%v)", imported, err)
+	}
+	if imported, _ := store.ImportFileStore(NewFileStore(filepath.Join(dir, "reposts.txt"))); imported {
+		t.Errorf("Expected nothing to be imported twice")
+	}
+
+	s = NewService(store, domain.StoryRules{})
+	_ = s.Register(DefaultConsumer)
+	if channel, found := store.findChannel("platform"); !found || channel != info {
+		t.Errorf("Expected channel info %+v to be imported, got %+v", info, channel)
+	}
+	reposts, _ := s.PickUp("bot", 0, false)
+	if len(reposts) != 1 || reposts[0].Pub.Id != "platform/id2" {
+		t.Errorf("Expected read state to be imported, got %v", reposts)
+	}
+	third, _ := s.RepostSelection(domain.Selection{Publication: domain.NewPublication("platform/id3", 10300, time.Now()), Rate: domain.SuggestionRate(5)})
+	if third.Id != 3 {
+		t.Errorf("Expected IDs to go on from the imported ones, got %d", third.Id)
+	}
+	if count := store.count(); count != 3 {
+		t.Errorf("Expected imported reposts to be counted, got %d", count)
+	}
+}
@@ -1,14 +1,35 @@
 package repost
 
 import (
+	"fmt"
 	"github.com/alexeyvy/tjlike-agenda/domain"
 	"time"
 )
 
 type Store interface {
-	insert(*entry)
-	walkAll(func(e *entry))
-	delete(entry)
+	insert(*entry) error
+	count() int
+	// findByPublication returns the latest entry of the publication
+	findByPublication(id domain.PublicationId) (*entry, bool)
+	// walkSharingStoryBands visits entries whose story signatures share any of the LSH bands, each entry once
+	walkSharingStoryBands(bands []uint64, handle func(e *entry))
+	// walkRepostedBetween visits entries reposted within [from, to) in chronological order, zero to means no upper bound
+	walkRepostedBetween(from, to time.Time, handle func(e *entry))
+	delete(entry) error
+	// walkAfter visits entries with greater IDs in order of IDs until handle returns false
+	walkAfter(id int, handle func(e *entry) bool)
+	// lastId tells ID given to the latest inserted entry even if it's deleted since, 0 if none
+	lastId() int
+	saveChannel(domain.ChannelInfo) error
+	findChannel(id string) (domain.ChannelInfo, bool)
+	// dead letters are entries purged before all consumers read them, walked in order of IDs
+	moveToDeadLetters(entry) error
+	walkDeadLetters(func(e *entry))
+	deleteDeadLetter(id int) error
+	// cursors keep ID of the last entry acknowledged by each registered consumer
+	saveCursor(consumer string, id int) error
+	findCursors() map[string]int
+	deleteCursor(consumer string) error
 }
 type LockableStore interface {
 	RLock()
@@ -23,9 +44,12 @@ type PersistentStore interface {
 
 type service struct {
 	s Store
+	// publications of an already reposted story count as existing
+	stories domain.StoryRules
 }
 
-func NewService(store Store) *service {
+// NewService works on top of the store, zero story rules mean that only reposts of the same publication count as existing
+func NewService(store Store, stories domain.StoryRules) *service {
 	persistentStore, isPersistentStore := store.(PersistentStore)
 	if isPersistentStore {
 		if err := persistentStore.Pull(); err != nil {
@@ -35,13 +59,11 @@ func NewService(store Store) *service {
 		}
 	}
 
-	return &service{store}
+	return &service{s: store, stories: stories}
 }
 
 var now = time.Now
 
-const hoursBeforePurge = 48
-
 type PersistDBFailed struct {
 	originalError error
 }
@@ -50,94 +72,402 @@ func (e *PersistDBFailed) Error() string {
 	return "cannot persist DB: " + e.originalError.Error()
 }
 
-func (r *service) Repost(publication domain.Publication, rate domain.SuggestionRate) (domain.Repost, error) {
-	repost := domain.NewRepost(publication, now(), rate)
-	dbEntry := &entry{repost, false, 0}
+// AckBeyondLatest tells a consumer tried to acknowledge a repost that hasn't been made yet
+type AckBeyondLatest struct {
+	Id     int
+	Latest int
+}
+
+func (e *AckBeyondLatest) Error() string {
+	return fmt.Sprintf("cannot acknowledge repost %d, the latest one is %d", e.Id, e.Latest)
+}
+
+// UnknownConsumer tells the consumer hasn't been registered, so it has no read state to read or change
+type UnknownConsumer struct {
+	Consumer string
+}
+
+func (e *UnknownConsumer) Error() string {
+	return fmt.Sprintf("consumer %s is not registered", e.Consumer)
+}
+
+// StoredRepost is a repost along with its position in the storage, increasing with every next repost.
+// Consumers acknowledge reposts up to it
+type StoredRepost struct {
+	Id int
+	domain.Repost
+}
+
+// RepostSelection stores the selected publication as a repost along with how it was selected
+func (r *service) RepostSelection(selection domain.Selection) (StoredRepost, error) {
+	publication := selection.Publication
+	repost := domain.NewRepost(publication, now(), selection.Rate)
+	repost.Rules = selection.Rules
+	repost.Explanation = selection.Explanation
 
 	lockableStore, isLockable := r.s.(LockableStore)
 	if isLockable {
 		lockableStore.Lock()
 		defer lockableStore.Unlock()
 	}
-	r.s.insert(dbEntry)
+	if channel, found := r.s.findChannel(publication.ChannelId); found {
+		repost.Channel = channel
+	} else {
+		repost.Channel = domain.NewChannelInfo(publication.ChannelId)
+	}
+	dbEntry := &entry{R: repost, Story: domain.NewStorySignature(publication)}
+	if err := r.s.insert(dbEntry); err != nil {
+		return StoredRepost{Repost: repost}, &PersistDBFailed{err}
+	}
+	stored := StoredRepost{dbEntry.Id, repost}
 
 	persistentStore, isPersistentStore := r.s.(PersistentStore)
 	if isPersistentStore {
 		if err := persistentStore.Push(); err != nil {
-			return repost, &PersistDBFailed{err}
+			return stored, &PersistDBFailed{err}
 		}
 	}
 
-	return repost, nil
+	return stored, nil
 }
 
-func (r *service) PickUpMostTrending(clearUp bool) []domain.Repost {
-	reposts := make([]domain.Repost, 0)
+// UpdateChannel keeps the latest known channel info so that reposts can tell where they came from.
+// A header that couldn't be scraped doesn't overwrite the known one
+func (r *service) UpdateChannel(info domain.ChannelInfo) error {
+	if !info.HeaderKnown() {
+		return nil
+	}
 
 	lockableStore, isLockable := r.s.(LockableStore)
 	if isLockable {
-		lockableStore.RLock()
-		defer lockableStore.RUnlock()
+		lockableStore.Lock()
+		defer lockableStore.Unlock()
+	}
+	if known, found := r.s.findChannel(info.Id); found && known == info {
+		return nil
+	}
+	if err := r.s.saveChannel(info); err != nil {
+		return &PersistDBFailed{err}
 	}
 
-	r.s.walkAll(func(e *entry) {
-		if e.RetrievedAtLeastOnce == false {
-			reposts = append(reposts, e.R)
-			if clearUp {
-				e.RetrievedAtLeastOnce = true
-			}
+	persistentStore, isPersistentStore := r.s.(PersistentStore)
+	if isPersistentStore {
+		if err := persistentStore.Push(); err != nil {
+			return &PersistDBFailed{err}
+		}
+	}
+
+	return nil
+}
+
+// DefaultConsumer reads reposts when no consumer is named, as all clients did before consumers were introduced
+const DefaultConsumer = "default"
+
+// cursorOf tells ID of the last repost acknowledged by the consumer. New consumers start from the very first stored repost
+func (r *service) cursorOf(consumer string) int {
+	if cursor, found := r.s.findCursors()[consumer]; found {
+		return cursor
+	}
+	if consumer != DefaultConsumer {
+		return 0
+	}
+	// the default consumer continues from where the read flag of DBs created before cursors left off
+	var cursor int
+	r.s.walkAfter(0, func(e *entry) bool {
+		if !e.RetrievedAtLeastOnce {
+			return false
 		}
+		cursor = e.Id
+		return true
 	})
+	return cursor
+}
 
-	return reposts
+func storedRepostOf(e *entry) StoredRepost {
+	repost := e.R
+	// entries stored before channels were have no channel info at all
+	if repost.Channel == (domain.ChannelInfo{}) {
+		repost.Channel = domain.NewChannelInfo(repost.Pub.ChannelId)
+	}
+	return StoredRepost{e.Id, repost}
 }
 
-type PurgeUnreadError struct{}
+// Register lets the consumer read reposts and makes retention keep those it hasn't acknowledged yet.
+// Registering twice has no effect
+func (r *service) Register(consumer string) error {
+	lockableStore, isLockable := r.s.(LockableStore)
+	if isLockable {
+		lockableStore.Lock()
+		defer lockableStore.Unlock()
+	}
+
+	if r.registered(consumer) {
+		return nil
+	}
+	return r.saveCursor(consumer, r.cursorOf(consumer))
+}
 
-func (e PurgeUnreadError) Error() string {
-	return "storage can't be emptied, as there are reposts that have not yet been pulled"
+func (r *service) registered(consumer string) bool {
+	_, found := r.s.findCursors()[consumer]
+	return found
 }
 
-func (r *service) PurgeIrrelevant() error {
-	repostedAtThreshold := now().Add(-1 * hoursBeforePurge * time.Hour)
-	entriesForDeletion := make([]entry, 0)
-	var unreadFound bool
+// Consumers tells ID of the last repost acknowledged by every registered consumer
+func (r *service) Consumers() map[string]int {
+	lockableStore, isLockable := r.s.(LockableStore)
+	if isLockable {
+		lockableStore.RLock()
+		defer lockableStore.RUnlock()
+	}
 
+	return r.s.findCursors()
+}
+
+// RemoveConsumer forgets the consumer along with its read state, so that retention no longer waits for it
+func (r *service) RemoveConsumer(consumer string) error {
 	lockableStore, isLockable := r.s.(LockableStore)
 	if isLockable {
 		lockableStore.Lock()
 		defer lockableStore.Unlock()
 	}
 
-	r.s.walkAll(func(e *entry) {
-		if e.R.RepostedAt.Before(repostedAtThreshold) {
-			if e.RetrievedAtLeastOnce == false {
-				unreadFound = true
-			}
-			entriesForDeletion = append(entriesForDeletion, *e)
+	if err := r.s.deleteCursor(consumer); err != nil {
+		return &PersistDBFailed{err}
+	}
+	persistentStore, isPersistentStore := r.s.(PersistentStore)
+	if isPersistentStore {
+		if err := persistentStore.Push(); err != nil {
+			return &PersistDBFailed{err}
 		}
+	}
+	return nil
+}
+
+// ReadAfter returns up to limit reposts following the one with the given ID, oldest first. 0 means no limit
+func (r *service) ReadAfter(id int, limit int) []StoredRepost {
+	lockableStore, isLockable := r.s.(LockableStore)
+	if isLockable {
+		lockableStore.RLock()
+		defer lockableStore.RUnlock()
+	}
+
+	return r.readAfter(id, limit)
+}
+
+func (r *service) readAfter(id int, limit int) []StoredRepost {
+	reposts := make([]StoredRepost, 0)
+	r.s.walkAfter(id, func(e *entry) bool {
+		reposts = append(reposts, storedRepostOf(e))
+		return limit <= 0 || len(reposts) < limit
 	})
+	return reposts
+}
+
+// Ack marks reposts up to the given ID as read by the consumer, acknowledging older ones has no effect.
+// Acknowledging a repost that hasn't been made yet fails with AckBeyondLatest
+func (r *service) Ack(consumer string, id int) error {
+	lockableStore, isLockable := r.s.(LockableStore)
+	if isLockable {
+		lockableStore.Lock()
+		defer lockableStore.Unlock()
+	}
 
-	if unreadFound {
-		return &PurgeUnreadError{}
+	if !r.registered(consumer) {
+		return &UnknownConsumer{consumer}
+	}
+	if latest := r.s.lastId(); id > latest {
+		return &AckBeyondLatest{id, latest}
+	}
+	if id <= r.cursorOf(consumer) {
+		return nil
 	}
+	return r.saveCursor(consumer, id)
+}
 
-	for _, e := range entriesForDeletion {
-		r.s.delete(e)
+// Replay makes the consumer read once again all reposts made since the given moment
+func (r *service) Replay(consumer string, since time.Time) error {
+	lockableStore, isLockable := r.s.(LockableStore)
+	if isLockable {
+		lockableStore.Lock()
+		defer lockableStore.Unlock()
 	}
 
+	if !r.registered(consumer) {
+		return &UnknownConsumer{consumer}
+	}
+	cursor := r.cursorOf(consumer)
+	r.s.walkRepostedBetween(since, time.Time{}, func(e *entry) {
+		if e.Id <= cursor {
+			cursor = e.Id - 1
+		}
+	})
+	return r.saveCursor(consumer, cursor)
+}
+
+func (r *service) saveCursor(consumer string, id int) error {
+	if err := r.s.saveCursor(consumer, id); err != nil {
+		return &PersistDBFailed{err}
+	}
 	persistentStore, isPersistentStore := r.s.(PersistentStore)
 	if isPersistentStore {
 		if err := persistentStore.Push(); err != nil {
 			return &PersistDBFailed{err}
 		}
 	}
-
 	return nil
 }
 
-func (r *service) ExistsForPublication(publication domain.Publication) bool {
-	var exists bool
+// PickUp reads up to limit reposts the consumer hasn't acknowledged yet, 0 means no limit, and acknowledges them
+// if clearUp is set. Concurrent pick-ups of the same consumer never get the same reposts
+func (r *service) PickUp(consumer string, limit int, clearUp bool) ([]StoredRepost, error) {
+	lockableStore, isLockable := r.s.(LockableStore)
+	if isLockable {
+		lockableStore.Lock()
+		defer lockableStore.Unlock()
+	}
+
+	if !r.registered(consumer) {
+		return nil, &UnknownConsumer{consumer}
+	}
+	reposts := r.readAfter(r.cursorOf(consumer), limit)
+	if clearUp && len(reposts) > 0 {
+		if err := r.saveCursor(consumer, reposts[len(reposts)-1].Id); err != nil {
+			return reposts, err
+		}
+	}
+	return reposts, nil
+}
+
+type StaleUnreadPolicy string
+
+const (
+	// StaleUnreadPurge purges stale reposts regardless of whether consumers have read them
+	StaleUnreadPurge StaleUnreadPolicy = "purge"
+	// StaleUnreadKeep keeps stale reposts until every consumer reads them
+	StaleUnreadKeep StaleUnreadPolicy = "keep"
+	// StaleUnreadDeadLetter moves stale reposts that are still unread aside, so that they can be looked into later
+	StaleUnreadDeadLetter StaleUnreadPolicy = "dead_letter"
+)
+
+// Retention tells which reposts are stale and how they get purged. Zero MaxAge and MaxCount mean no limit
+type Retention struct {
+	MaxAge time.Duration
+	// number of the latest reposts kept
+	MaxCount int
+	// nothing is ever purged, e.g. to keep history for analytics
+	KeepForever bool
+	StaleUnread StaleUnreadPolicy
+}
+
+func DefaultRetention() Retention {
+	return Retention{MaxAge: 48 * time.Hour, StaleUnread: StaleUnreadKeep}
+}
+
+type PurgeStats struct {
+	Purged       int
+	DeadLettered int
+	// stale reposts kept as some consumers haven't read them yet
+	KeptUnread int
+	// dead letters that got stale themselves
+	DeadLettersPurged int
+}
+
+// Purge deletes stale reposts according to the retention, dead letters become stale by the same rules
+func (r *service) Purge(retention Retention) (PurgeStats, error) {
+	var stats PurgeStats
+	if retention.KeepForever || (retention.MaxAge <= 0 && retention.MaxCount <= 0) {
+		return stats, nil
+	}
+
+	lockableStore, isLockable := r.s.(LockableStore)
+	if isLockable {
+		lockableStore.Lock()
+		defer lockableStore.Unlock()
+	}
+
+	cursors := r.s.findCursors()
+	if len(cursors) == 0 {
+		cursors[DefaultConsumer] = r.cursorOf(DefaultConsumer)
+	}
+	repostedAtThreshold := now().Add(-retention.MaxAge)
+
+	// only the stale end of the store is walked
+	var stale []*entry
+	if excess := r.s.count() - retention.MaxCount; retention.MaxCount > 0 && excess > 0 {
+		r.s.walkAfter(0, func(e *entry) bool {
+			stale = append(stale, e)
+			return len(stale) < excess
+		})
+	}
+	if retention.MaxAge > 0 {
+		tooMany := make(map[int]bool, len(stale))
+		for _, e := range stale {
+			tooMany[e.Id] = true
+		}
+		r.s.walkRepostedBetween(time.Time{}, repostedAtThreshold, func(e *entry) {
+			if !tooMany[e.Id] {
+				stale = append(stale, e)
+			}
+		})
+	}
+
+	for _, e := range stale {
+		var unread bool
+		for _, cursor := range cursors {
+			if e.Id > cursor {
+				unread = true
+			}
+		}
+		if unread {
+			switch retention.StaleUnread {
+			case StaleUnreadKeep:
+				stats.KeptUnread++
+				continue
+			case StaleUnreadDeadLetter:
+				e.DeadLetteredAt = now()
+				if err := r.s.moveToDeadLetters(*e); err != nil {
+					return stats, &PersistDBFailed{err}
+				}
+				stats.DeadLettered++
+				stats.Purged++
+				continue
+			}
+		}
+		if err := r.s.delete(*e); err != nil {
+			return stats, &PersistDBFailed{err}
+		}
+		stats.Purged++
+	}
+
+	var deadLetters []*entry
+	r.s.walkDeadLetters(func(e *entry) {
+		deadLetters = append(deadLetters, e)
+	})
+	for k, e := range deadLetters {
+		tooOld := retention.MaxAge > 0 && e.DeadLetteredAt.Before(repostedAtThreshold)
+		tooMany := retention.MaxCount > 0 && k < len(deadLetters)-retention.MaxCount
+		if !tooOld && !tooMany {
+			continue
+		}
+		if err := r.s.deleteDeadLetter(e.Id); err != nil {
+			return stats, &PersistDBFailed{err}
+		}
+		stats.DeadLettersPurged++
+	}
+
+	persistentStore, isPersistentStore := r.s.(PersistentStore)
+	if isPersistentStore && (stats.Purged > 0 || stats.DeadLettersPurged > 0) {
+		if err := persistentStore.Push(); err != nil {
+			return stats, &PersistDBFailed{err}
+		}
+	}
+
+	return stats, nil
+}
+
+// DeadLetters lists stale reposts purged before all consumers read them, oldest first
+func (r *service) DeadLetters() []StoredRepost {
+	reposts := make([]StoredRepost, 0)
 
 	lockableStore, isLockable := r.s.(LockableStore)
 	if isLockable {
@@ -145,8 +475,51 @@ func (r *service) ExistsForPublication(publication domain.Publication) bool {
 		defer lockableStore.RUnlock()
 	}
 
-	r.s.walkAll(func(e *entry) {
-		if e.R.Pub.Id == publication.Id {
+	r.s.walkDeadLetters(func(e *entry) {
+		reposts = append(reposts, storedRepostOf(e))
+	})
+	return reposts
+}
+
+// RepostTimesOfChannel lists when publications of the channel were reposted since the given moment
+func (r *service) RepostTimesOfChannel(channelId string, since time.Time) []time.Time {
+	var repostTimes []time.Time
+
+	lockableStore, isLockable := r.s.(LockableStore)
+	if isLockable {
+		lockableStore.RLock()
+		defer lockableStore.RUnlock()
+	}
+
+	r.s.walkRepostedBetween(since, time.Time{}, func(e *entry) {
+		if e.R.Pub.ChannelId == channelId {
+			repostTimes = append(repostTimes, e.R.RepostedAt)
+		}
+	})
+
+	return repostTimes
+}
+
+// ExistsForPublication also tells whether the publication's story has been reposted, if story rules are set
+func (r *service) ExistsForPublication(publication domain.Publication) bool {
+	lockableStore, isLockable := r.s.(LockableStore)
+	if isLockable {
+		lockableStore.RLock()
+		defer lockableStore.RUnlock()
+	}
+
+	if _, found := r.s.findByPublication(publication.Id); found {
+		return true
+	}
+	signature := domain.NewStorySignature(publication)
+	if signature == nil || r.stories.Similarity <= 0 {
+		return false
+	}
+
+	var exists bool
+	// only reposts sharing an LSH bucket with the publication can be of the same story
+	r.s.walkSharingStoryBands(signature.Bands(), func(e *entry) {
+		if !exists && r.stories.SameStory(signature, e.story()) {
 			exists = true
 		}
 	})
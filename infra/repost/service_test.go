@@ -1,7 +1,10 @@
 package repost
 
 import (
+	"errors"
 	"github.com/alexeyvy/tjlike-agenda/domain"
+	"reflect"
+	"strconv"
 	"testing"
 	"time"
 )
@@ -9,34 +12,35 @@ import (
 func TestSaveAndPickup(t *testing.T) {
 	t.Parallel()
 
-	s := NewService(NewInMemoryStore())
+	s := NewService(NewInMemoryStore(), domain.StoryRules{})
+	_ = s.Register(DefaultConsumer)
 
 	postedAt, _ := time.Parse(time.RFC822, "02 Jan 06 15:04 MST")
-	repost, err := s.Repost(domain.NewPublication("platform/id", 10300, postedAt), domain.SuggestionRate(5))
+	repost, err := s.RepostSelection(domain.Selection{Publication: domain.NewPublication("platform/id", 10300, postedAt), Rate: domain.SuggestionRate(5)})
 	if err != nil {
 		t.Errorf(
 			"Repost() threw an error: " + err.Error(),
 		)
 	}
-	if repost == (domain.Repost{}) {
+	if reflect.DeepEqual(repost, StoredRepost{}) {
 		t.Errorf(
 			"Returned repost is empty",
 		)
 	}
 
-	reposts := s.PickUpMostTrending(false)
+	reposts, _ := s.PickUp(DefaultConsumer, 0, false)
 	if len(reposts) != 1 {
 		t.Errorf(
 			"Picking up saved repost failed",
 		)
 	}
-	reposts = s.PickUpMostTrending(true)
+	reposts, _ = s.PickUp(DefaultConsumer, 0, true)
 	if len(reposts) != 1 {
 		t.Errorf(
 			"Dry mode failed, cannot pick up repetatively",
 		)
 	}
-	reposts = s.PickUpMostTrending(false)
+	reposts, _ = s.PickUp(DefaultConsumer, 0, false)
 	if len(reposts) != 0 {
 		t.Errorf(
 			"%d entries left off after picked up in wet mode", len(reposts),
@@ -44,23 +48,329 @@ func TestSaveAndPickup(t *testing.T) {
 	}
 }
 
-func TestPurgeIrrelevant(t *testing.T) {
+func TestPurge(t *testing.T) {
+	defer func(original func() time.Time) { now = original }(now)
+	var currentTime time.Time
+	now = func() time.Time { return currentTime }
+	postedAt, _ := time.Parse(time.RFC822, "02 Jan 06 15:04 MST")
+
+	cases := []struct {
+		name      string
+		retention Retention
+		// reposts acknowledged by the default consumer, out of the 3 made two days apart
+		acknowledged int
+		want         PurgeStats
+		wantLeft     []domain.PublicationId
+		wantDead     []domain.PublicationId
+	}{
+		{
+			"read stale reposts purged",
+			Retention{MaxAge: 48 * time.Hour, StaleUnread: StaleUnreadKeep},
+			2,
+			PurgeStats{Purged: 2},
+			[]domain.PublicationId{"platform/3"},
+			nil,
+		},
+		{
+			"unread stale reposts kept",
+			Retention{MaxAge: 48 * time.Hour, StaleUnread: StaleUnreadKeep},
+			1,
+			PurgeStats{Purged: 1, KeptUnread: 1},
+			[]domain.PublicationId{"platform/2", "platform/3"},
+			nil,
+		},
+		{
+			"unread stale reposts purged anyway",
+			Retention{MaxAge: 48 * time.Hour, StaleUnread: StaleUnreadPurge},
+			0,
+			PurgeStats{Purged: 2},
+			[]domain.PublicationId{"platform/3"},
+			nil,
+		},
+		{
+			"unread stale reposts dead-lettered",
+			Retention{MaxAge: 48 * time.Hour, StaleUnread: StaleUnreadDeadLetter},
+			1,
+			PurgeStats{Purged: 2, DeadLettered: 1},
+			[]domain.PublicationId{"platform/3"},
+			[]domain.PublicationId{"platform/2"},
+		},
+		{
+			"max count",
+			Retention{MaxCount: 1, StaleUnread: StaleUnreadKeep},
+			3,
+			PurgeStats{Purged: 2},
+			[]domain.PublicationId{"platform/3"},
+			nil,
+		},
+		{
+			"keep forever",
+			Retention{MaxAge: time.Hour, MaxCount: 1, KeepForever: true, StaleUnread: StaleUnreadPurge},
+			3,
+			PurgeStats{},
+			[]domain.PublicationId{"platform/1", "platform/2", "platform/3"},
+			nil,
+		},
+	}
+	for _, c := range cases {
+		s := NewService(NewInMemoryStore(), domain.StoryRules{})
+		_ = s.Register(DefaultConsumer)
+		for k := 1; k <= 3; k++ {
+			currentTime = postedAt.Add(time.Duration(k) * 48 * time.Hour)
+			_, _ = s.RepostSelection(domain.Selection{Publication: domain.NewPublication("platform/"+strconv.Itoa(k), 10300, postedAt), Rate: domain.SuggestionRate(5)})
+		}
+		if c.acknowledged > 0 {
+			_ = s.Ack(DefaultConsumer, c.acknowledged)
+		}
+
+		currentTime = currentTime.Add(time.Hour)
+		stats, err := s.Purge(c.retention)
+		if err != nil {
+			t.Errorf("%s: Purge() threw an error: %v", c.name, err)
+		}
+		if stats != c.want {
+			t.Errorf("%s: got stats %+v, want %+v", c.name, stats, c.want)
+		}
+		if left := publicationIds(s.ReadAfter(0, 0)); !reflect.DeepEqual(left, c.wantLeft) {
+			t.Errorf("%s: got %v left, want %v", c.name, left, c.wantLeft)
+		}
+		if dead := publicationIds(s.DeadLetters()); !reflect.DeepEqual(dead, c.wantDead) {
+			t.Errorf("%s: got %v dead-lettered, want %v", c.name, dead, c.wantDead)
+		}
+	}
+}
+
+func publicationIds(reposts []StoredRepost) []domain.PublicationId {
+	var ids []domain.PublicationId
+	for _, r := range reposts {
+		ids = append(ids, r.Pub.Id)
+	}
+	return ids
+}
+
+func TestRepostCarriesChannelInfo(t *testing.T) {
 	t.Parallel()
 
-	var currentTime string
-	now = func() time.Time { a, _ := time.Parse(time.RFC822, currentTime); return a }
+	s := NewService(NewInMemoryStore(), domain.StoryRules{})
+	_ = s.Register(DefaultConsumer)
+	info := domain.NewChannelInfo("platform")
+	info.Title = "Platform channel"
+	if err := s.UpdateChannel(info); err != nil {
+		t.Errorf("UpdateChannel() threw an error: " + err.Error())
+	}
+
+	publication := domain.NewPublication("platform/id", 10300, time.Now())
+	publication.ChannelId = "platform"
+	repost, _ := s.RepostSelection(domain.Selection{Publication: publication, Rate: domain.SuggestionRate(5)})
+	if repost.Channel != info {
+		t.Errorf("Expected repost to carry channel info %+v, got %+v", info, repost.Channel)
+	}
 
-	s := NewService(NewInMemoryStore())
+	if err := s.UpdateChannel(domain.NewChannelInfo("platform")); err != nil {
+		t.Errorf("UpdateChannel() threw an error: " + err.Error())
+	}
+	repost, _ = s.RepostSelection(domain.Selection{Publication: domain.NewPublication("platform/id2", 10300, time.Now()), Rate: domain.SuggestionRate(5)})
+	if repost.Channel != domain.NewChannelInfo("") {
+		t.Errorf("Expected unknown channel to have unknown subscribers, got %+v", repost.Channel)
+	}
+	publication = domain.NewPublication("platform/id3", 10300, time.Now())
+	publication.ChannelId = "platform"
+	repost, _ = s.RepostSelection(domain.Selection{Publication: publication, Rate: domain.SuggestionRate(5)})
+	if repost.Channel != info {
+		t.Errorf("Expected empty header to keep channel info %+v, got %+v", info, repost.Channel)
+	}
+}
 
-	currentTime = "02 Jan 06 15:06 MST"
-	postedAt, _ := time.Parse(time.RFC822, "02 Jan 06 15:04 MST")
-	_, _ = s.Repost(domain.NewPublication("platform/id", 10300, postedAt), domain.SuggestionRate(5))
+func TestExistsForPublicationOfRepostedStory(t *testing.T) {
+	t.Parallel()
 
-	currentTime = "06 Jan 06 15:06 MST"
-	err := s.PurgeIrrelevant()
-	if err == nil {
-		t.Errorf(
-			"PurgeUnreadError expected",
-		)
+	s := NewService(NewInMemoryStore(), domain.StoryRules{Similarity: 0.5})
+	_ = s.Register(DefaultConsumer)
+
+	original := domain.NewPublication("source/1", 10300, time.Now())
+	original.Content.Text = "The central bank raised the key rate to 12 percent at an unscheduled meeting on Tuesday morning"
+	_, _ = s.RepostSelection(domain.Selection{Publication: original, Rate: domain.SuggestionRate(5)})
+
+	copied := domain.NewPublication("aggregator/1", 20600, time.Now())
+	copied.Content.Text = "BREAKING: the central bank raised the key rate to 12 percent at an unscheduled meeting on Tuesday morning"
+	if !s.ExistsForPublication(copied) {
+		t.Errorf("Expected a copy of the reposted story to exist")
+	}
+
+	unrelated := domain.NewPublication("aggregator/2", 20600, time.Now())
+	unrelated.Content.Text = "Heavy snowfall is expected in the capital over the weekend"
+	if s.ExistsForPublication(unrelated) {
+		t.Errorf("Expected an unrelated publication not to exist")
+	}
+}
+
+func TestRepostRecordsAppliedRules(t *testing.T) {
+	t.Parallel()
+
+	s := NewService(NewInMemoryStore(), domain.StoryRules{})
+	_ = s.Register(DefaultConsumer)
+	rules := []domain.AppliedRule{{Name: "elections", Action: domain.RuleActionMultiply, Factor: 1.5}}
+	_, _ = s.RepostSelection(domain.Selection{
+		Publication: domain.NewPublication("platform/id", 10300, time.Now()),
+		Rate:        domain.SuggestionRate(5),
+		Rules:       rules,
+	})
+
+	reposts, _ := s.PickUp(DefaultConsumer, 0, false)
+	if len(reposts) != 1 || !reflect.DeepEqual(reposts[0].Rules, rules) {
+		t.Errorf("Expected applied rules %v to be recorded on the repost, got %v", rules, reposts)
+	}
+}
+
+func TestConsumersReadIndependently(t *testing.T) {
+	t.Parallel()
+
+	s := NewService(NewInMemoryStore(), domain.StoryRules{})
+	postedAt := time.Unix(1661773286, 0)
+	for _, id := range []string{"platform/1", "platform/2", "platform/3"} {
+		_, _ = s.RepostSelection(domain.Selection{Publication: domain.NewPublication(id, 10300, postedAt), Rate: domain.SuggestionRate(5)})
+	}
+
+	var unknownConsumer *UnknownConsumer
+	if _, err := s.PickUp("site", 0, true); !errors.As(err, &unknownConsumer) {
+		t.Errorf("Expected unregistered site not to read anything, got %v", err)
+	}
+	if err := s.Ack("site", 1); !errors.As(err, &unknownConsumer) {
+		t.Errorf("Expected unregistered site not to acknowledge anything, got %v", err)
+	}
+	if consumers := s.Consumers(); len(consumers) != 0 {
+		t.Errorf("Expected nothing registered by reading or acknowledging, got %v", consumers)
+	}
+
+	_ = s.Register("site")
+	_ = s.Register("bot")
+	if reposts, _ := s.PickUp("site", 0, true); len(reposts) != 3 {
+		t.Errorf("Expected site to read all 3 reposts, got %d", len(reposts))
+	}
+	if reposts, _ := s.PickUp("site", 0, true); len(reposts) != 0 {
+		t.Errorf("Expected nothing left for site after acknowledging, got %d", len(reposts))
+	}
+
+	reposts, _ := s.PickUp("bot", 2, false)
+	if len(reposts) != 2 || reposts[0].Pub.Id != "platform/1" {
+		t.Fatalf("Expected bot to read the first 2 reposts regardless of site, got %v", reposts)
+	}
+	var beyondLatest *AckBeyondLatest
+	if err := s.Ack("bot", 4); !errors.As(err, &beyondLatest) {
+		t.Errorf("Expected acknowledging a repost not made yet to fail, got %v", err)
+	}
+	if err := s.Ack("bot", reposts[0].Id); err != nil {
+		t.Errorf("Ack() threw an error: %v", err)
+	}
+	if reposts, _ := s.PickUp("bot", 0, false); len(reposts) != 2 || reposts[0].Pub.Id != "platform/2" {
+		t.Errorf("Expected bot to continue after the acknowledged repost, got %v", reposts)
+	}
+
+	if err := s.Replay("site", time.Time{}); err != nil {
+		t.Errorf("Replay() threw an error: %v", err)
+	}
+	if reposts, _ := s.PickUp("site", 0, false); len(reposts) != 3 {
+		t.Errorf("Expected site to read all 3 reposts once again after replay, got %d", len(reposts))
+	}
+}
+
+func TestDefaultConsumerContinuesFromReadFlag(t *testing.T) {
+	t.Parallel()
+
+	store := NewInMemoryStore()
+	for k, retrieved := range []bool{true, true, false} {
+		publication := domain.NewPublication("platform/"+strconv.Itoa(k), 10300, time.Now())
+		_ = store.insert(&entry{R: domain.NewRepost(publication, time.Now(), 5), RetrievedAtLeastOnce: retrieved})
+	}
+
+	s := NewService(store, domain.StoryRules{})
+	_ = s.Register(DefaultConsumer)
+	reposts, _ := s.PickUp(DefaultConsumer, 0, false)
+	if len(reposts) != 1 || reposts[0].Pub.Id != "platform/2" {
+		t.Errorf("Expected only the repost not retrieved before cursors, got %v", reposts)
+	}
+}
+
+func TestReadAfterDoesNotChangeReadState(t *testing.T) {
+	t.Parallel()
+
+	s := NewService(NewInMemoryStore(), domain.StoryRules{})
+	_ = s.Register(DefaultConsumer)
+	for _, id := range []string{"platform/1", "platform/2", "platform/3"} {
+		_, _ = s.RepostSelection(domain.Selection{Publication: domain.NewPublication(id, 10300, time.Now()), Rate: domain.SuggestionRate(5)})
+	}
+
+	page := s.ReadAfter(0, 2)
+	if len(page) != 2 || page[0].Pub.Id != "platform/1" {
+		t.Fatalf("Expected the first page of 2 reposts, got %v", page)
+	}
+	if page = s.ReadAfter(page[1].Id, 2); len(page) != 1 || page[0].Pub.Id != "platform/3" {
+		t.Errorf("Expected the last repost on the second page, got %v", page)
+	}
+	if reposts, _ := s.PickUp(DefaultConsumer, 0, false); len(reposts) != 3 {
+		t.Errorf("Expected paging not to acknowledge anything, got %d unread", len(reposts))
+	}
+}
+
+func TestRegisteredConsumerKeepsUnreadUntilRemoved(t *testing.T) {
+	defer func(original func() time.Time) { now = original }(now)
+	var currentTime time.Time
+	now = func() time.Time { return currentTime }
+
+	s := NewService(NewInMemoryStore(), domain.StoryRules{})
+	_ = s.Register(DefaultConsumer)
+	postedAt := time.Unix(1661773286, 0)
+	currentTime = postedAt
+	_, _ = s.RepostSelection(domain.Selection{Publication: domain.NewPublication("platform/1", 10300, postedAt), Rate: domain.SuggestionRate(5)})
+	_ = s.Ack(DefaultConsumer, 1)
+
+	if err := s.Register("bot"); err != nil {
+		t.Errorf("Register() threw an error: %v", err)
+	}
+	if consumers := s.Consumers(); !reflect.DeepEqual(consumers, map[string]int{DefaultConsumer: 1, "bot": 0}) {
+		t.Errorf("Expected bot registered with nothing acknowledged, got %v", consumers)
+	}
+
+	currentTime = postedAt.Add(72 * time.Hour)
+	retention := Retention{MaxAge: 48 * time.Hour, StaleUnread: StaleUnreadKeep}
+	if stats, _ := s.Purge(retention); stats != (PurgeStats{KeptUnread: 1}) {
+		t.Errorf("Expected the repost unread by bot to be kept, got %+v", stats)
+	}
+
+	if err := s.RemoveConsumer("bot"); err != nil {
+		t.Errorf("RemoveConsumer() threw an error: %v", err)
+	}
+	if stats, _ := s.Purge(retention); stats != (PurgeStats{Purged: 1}) {
+		t.Errorf("Expected the repost purged once bot is removed, got %+v", stats)
+	}
+}
+
+func TestPurgeAppliesRetentionToDeadLetters(t *testing.T) {
+	defer func(original func() time.Time) { now = original }(now)
+	var currentTime time.Time
+	now = func() time.Time { return currentTime }
+
+	s := NewService(NewInMemoryStore(), domain.StoryRules{})
+	_ = s.Register(DefaultConsumer)
+	postedAt := time.Unix(1661773286, 0)
+	currentTime = postedAt
+	_, _ = s.RepostSelection(domain.Selection{Publication: domain.NewPublication("platform/1", 10300, postedAt), Rate: domain.SuggestionRate(5)})
+
+	retention := Retention{MaxAge: 48 * time.Hour, StaleUnread: StaleUnreadDeadLetter}
+	currentTime = postedAt.Add(72 * time.Hour)
+	if stats, _ := s.Purge(retention); stats != (PurgeStats{Purged: 1, DeadLettered: 1}) {
+		t.Errorf("Expected the unread repost dead-lettered, got %+v", stats)
+	}
+	// dead letters age since they were dead-lettered, not since reposted
+	currentTime = currentTime.Add(24 * time.Hour)
+	if stats, _ := s.Purge(retention); stats != (PurgeStats{}) {
+		t.Errorf("Expected the fresh dead letter kept, got %+v", stats)
+	}
+	currentTime = currentTime.Add(48 * time.Hour)
+	if stats, _ := s.Purge(retention); stats != (PurgeStats{DeadLettersPurged: 1}) {
+		t.Errorf("Expected the stale dead letter purged, got %+v", stats)
+	}
+	if dead := s.DeadLetters(); len(dead) != 0 {
+		t.Errorf("Expected no dead letters left, got %v", dead)
 	}
 }
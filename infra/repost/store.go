@@ -6,37 +6,204 @@ import (
 	"fmt"
 	"github.com/alexeyvy/tjlike-agenda/domain"
 	"os"
+	"sort"
 	"sync"
+	"time"
 )
 
 type entry struct {
-	R                    domain.Repost
+	R domain.Repost
+	// Deprecated: read state is kept by consumer cursors, the flag only tells where the default consumer stopped in DBs created before them
 	RetrievedAtLeastOnce bool
 	Id                   int
+	Story                domain.StorySignature `json:",omitempty"`
+	// only set on dead letters, their age is counted from it
+	DeadLetteredAt time.Time `json:",omitempty"`
+}
+
+// story is computed on the fly for entries stored before signatures were
+func (e *entry) story() domain.StorySignature {
+	if e.Story == nil {
+		return domain.NewStorySignature(e.R.Pub)
+	}
+	return e.Story
 }
 
 type InMemoryStore struct {
-	entries map[int]*entry
-	nextId  int
+	entries  map[int]*entry
+	nextId   int
+	channels map[string]domain.ChannelInfo
+	// ID of the last entry acknowledged by each consumer
+	cursors     map[string]int
+	deadLetters map[int]*entry
+	// indexes are not persisted, they are rebuilt out of entries
+	byPublication map[domain.PublicationId]*entry
+	// IDs of entries by LSH bands of their story signatures, deleted ones are left until reindexing
+	byStoryBand map[uint64][]int
+	// ordered by reposted-at moment, deleted entries are left in place until they make up half of it
+	byRepostedAt []repostedAtKey
+	deleted      int
 	sync.RWMutex
 }
 
+type repostedAtKey struct {
+	at time.Time
+	id int
+}
+
+func (k repostedAtKey) before(other repostedAtKey) bool {
+	if !k.at.Equal(other.at) {
+		return k.at.Before(other.at)
+	}
+	return k.id < other.id
+}
+
 func NewInMemoryStore() *InMemoryStore {
-	return &InMemoryStore{make(map[int]*entry, 0), 1, sync.RWMutex{}}
+	return &InMemoryStore{
+		entries:       make(map[int]*entry, 0),
+		nextId:        1,
+		channels:      make(map[string]domain.ChannelInfo),
+		cursors:       make(map[string]int),
+		deadLetters:   make(map[int]*entry),
+		byPublication: make(map[domain.PublicationId]*entry),
+		byStoryBand:   make(map[uint64][]int),
+	}
 }
 
-func (s *InMemoryStore) insert(e *entry) {
+func (s *InMemoryStore) insert(e *entry) error {
 	e.Id = s.nextId
 	s.entries[e.Id] = e
 	s.nextId += 1
+	s.index(e)
+	return nil
+}
+func (s *InMemoryStore) index(e *entry) {
+	s.byPublication[e.R.Pub.Id] = e
+	s.indexStory(e)
+	key := repostedAtKey{e.R.RepostedAt, e.Id}
+	// reposts come in chronological order, so it's almost always an append
+	k := len(s.byRepostedAt)
+	for k > 0 && key.before(s.byRepostedAt[k-1]) {
+		k--
+	}
+	s.byRepostedAt = append(s.byRepostedAt, repostedAtKey{})
+	copy(s.byRepostedAt[k+1:], s.byRepostedAt[k:])
+	s.byRepostedAt[k] = key
+}
+func (s *InMemoryStore) indexStory(e *entry) {
+	for _, band := range e.story().Bands() {
+		s.byStoryBand[band] = append(s.byStoryBand[band], e.Id)
+	}
 }
-func (s *InMemoryStore) walkAll(handle func(e *entry)) {
-	for k := range s.entries {
-		handle(s.entries[k])
+func (s *InMemoryStore) reindex() {
+	s.byPublication = make(map[domain.PublicationId]*entry, len(s.entries))
+	s.byStoryBand = make(map[uint64][]int)
+	s.byRepostedAt = make([]repostedAtKey, 0, len(s.entries))
+	for id, e := range s.entries {
+		s.byPublication[e.R.Pub.Id] = e
+		s.indexStory(e)
+		s.byRepostedAt = append(s.byRepostedAt, repostedAtKey{e.R.RepostedAt, id})
 	}
+	sort.Slice(s.byRepostedAt, func(i, j int) bool { return s.byRepostedAt[i].before(s.byRepostedAt[j]) })
+	s.deleted = 0
 }
-func (s *InMemoryStore) delete(e entry) {
+func (s *InMemoryStore) walkAfter(id int, handle func(e *entry) bool) {
+	for k := id + 1; k < s.nextId; k++ {
+		if e, found := s.entries[k]; found && !handle(e) {
+			return
+		}
+	}
+}
+func (s *InMemoryStore) count() int {
+	return len(s.entries)
+}
+func (s *InMemoryStore) lastId() int {
+	return s.nextId - 1
+}
+func (s *InMemoryStore) findByPublication(id domain.PublicationId) (*entry, bool) {
+	e, found := s.byPublication[id]
+	return e, found
+}
+func (s *InMemoryStore) walkSharingStoryBands(bands []uint64, handle func(e *entry)) {
+	visited := make(map[int]bool)
+	for _, band := range bands {
+		for _, id := range s.byStoryBand[band] {
+			if e, found := s.entries[id]; found && !visited[id] {
+				visited[id] = true
+				handle(e)
+			}
+		}
+	}
+}
+func (s *InMemoryStore) walkRepostedBetween(from, to time.Time, handle func(e *entry)) {
+	k := sort.Search(len(s.byRepostedAt), func(k int) bool { return !s.byRepostedAt[k].at.Before(from) })
+	for ; k < len(s.byRepostedAt); k++ {
+		key := s.byRepostedAt[k]
+		if !to.IsZero() && !key.at.Before(to) {
+			return
+		}
+		if e, found := s.entries[key.id]; found {
+			handle(e)
+		}
+	}
+}
+func (s *InMemoryStore) delete(e entry) error {
+	if _, found := s.entries[e.Id]; !found {
+		return nil
+	}
 	delete(s.entries, e.Id)
+	if indexed, found := s.byPublication[e.R.Pub.Id]; found && indexed.Id == e.Id {
+		delete(s.byPublication, e.R.Pub.Id)
+	}
+	s.deleted++
+	if s.deleted > len(s.byRepostedAt)/2 {
+		s.reindex()
+	}
+	return nil
+}
+func (s *InMemoryStore) saveChannel(info domain.ChannelInfo) error {
+	s.channels[info.Id] = info
+	return nil
+}
+func (s *InMemoryStore) findChannel(id string) (domain.ChannelInfo, bool) {
+	info, found := s.channels[id]
+	return info, found
+}
+func (s *InMemoryStore) moveToDeadLetters(e entry) error {
+	if err := s.delete(e); err != nil {
+		return err
+	}
+	s.deadLetters[e.Id] = &e
+	return nil
+}
+func (s *InMemoryStore) deleteDeadLetter(id int) error {
+	delete(s.deadLetters, id)
+	return nil
+}
+func (s *InMemoryStore) walkDeadLetters(handle func(e *entry)) {
+	ids := make([]int, 0, len(s.deadLetters))
+	for id := range s.deadLetters {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		handle(s.deadLetters[id])
+	}
+}
+func (s *InMemoryStore) saveCursor(consumer string, id int) error {
+	s.cursors[consumer] = id
+	return nil
+}
+func (s *InMemoryStore) deleteCursor(consumer string) error {
+	delete(s.cursors, consumer)
+	return nil
+}
+func (s *InMemoryStore) findCursors() map[string]int {
+	cursors := make(map[string]int, len(s.cursors))
+	for consumer, id := range s.cursors {
+		cursors[consumer] = id
+	}
+	return cursors
 }
 
 type FileStore struct {
@@ -49,8 +216,11 @@ func NewFileStore(path string) *FileStore {
 }
 
 type jsonRepresentation struct {
-	Entries map[int]*entry
-	NextId  int
+	Entries     map[int]*entry
+	NextId      int
+	Channels    map[string]domain.ChannelInfo
+	Cursors     map[string]int
+	DeadLetters map[int]*entry
 }
 
 var ErrDBNotInited = errors.New("cannot initialize store as the source does not exist")
@@ -67,14 +237,45 @@ func (fs *FileStore) Pull() error {
 	}
 	fs.entries = jr.Entries
 	fs.nextId = jr.NextId
+	fs.reindex()
+	// DBs created before channels were stored have none
+	if jr.Channels != nil {
+		fs.channels = jr.Channels
+	}
+	if jr.Cursors != nil {
+		fs.cursors = jr.Cursors
+	}
+	if jr.DeadLetters != nil {
+		fs.deadLetters = jr.DeadLetters
+	}
 	return nil
 }
 func (fs *FileStore) Push() error {
-	jr := jsonRepresentation{fs.entries, fs.nextId}
+	jr := jsonRepresentation{fs.entries, fs.nextId, fs.channels, fs.cursors, fs.deadLetters}
 	jsonEncoded, _ := json.Marshal(jr)
-	err := os.WriteFile(fs.path, jsonEncoded, 0644)
-	if err != nil {
+	// written aside, synced and renamed, so that a crash in the middle of writing doesn't corrupt the DB
+	tmpPath := fs.path + ".tmp"
+	if err := writeSynced(tmpPath, jsonEncoded); err != nil {
 		return fmt.Errorf("cannot write DB file: %w", err)
 	}
+	if err := os.Rename(tmpPath, fs.path); err != nil {
+		return fmt.Errorf("cannot replace DB file: %w", err)
+	}
 	return nil
 }
+
+func writeSynced(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
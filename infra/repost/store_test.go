@@ -2,6 +2,9 @@ package repost
 
 import (
 	"github.com/alexeyvy/tjlike-agenda/domain"
+	"path/filepath"
+	"reflect"
+	"strconv"
 	"testing"
 	"time"
 )
@@ -16,8 +19,9 @@ func TestInMemoryInsertAndRead(t *testing.T) {
 	})
 
 	entries := make([]entry, 0)
-	s.walkAll(func(e *entry) {
+	s.walkAfter(0, func(e *entry) bool {
 		entries = append(entries, *e)
+		return true
 	})
 	if len(entries) != 2 {
 		t.Errorf(
@@ -37,12 +41,13 @@ func TestInMemoryIdSequence(t *testing.T) {
 	}
 	s.insert(&e2)
 
-	s.walkAll(func(e *entry) {
+	s.walkAfter(0, func(e *entry) bool {
 		if e.Id != 1 && e.Id != 2 {
 			t.Errorf(
 				"Expected sequential IDs 1 and 2, got %d", e.Id,
 			)
 		}
+		return true
 	})
 }
 
@@ -61,8 +66,9 @@ func TestInMemoryDeletion(t *testing.T) {
 	s.delete(e1)
 
 	entries := make([]entry, 0)
-	s.walkAll(func(e *entry) {
+	s.walkAfter(0, func(e *entry) bool {
 		entries = append(entries, *e)
+		return true
 	})
 	if len(entries) != 1 {
 		t.Errorf(
@@ -73,8 +79,9 @@ func TestInMemoryDeletion(t *testing.T) {
 	s.delete(e2)
 
 	entries = make([]entry, 0)
-	s.walkAll(func(e *entry) {
+	s.walkAfter(0, func(e *entry) bool {
 		entries = append(entries, *e)
+		return true
 	})
 	if len(entries) != 0 {
 		t.Errorf(
@@ -82,3 +89,135 @@ func TestInMemoryDeletion(t *testing.T) {
 		)
 	}
 }
+
+func TestKeyedLookups(t *testing.T) {
+	t.Parallel()
+
+	bolt, err := NewBoltStore(filepath.Join(t.TempDir(), "reposts.db"))
+	if err != nil {
+		t.Fatalf("NewBoltStore() threw an error: %v", err)
+	}
+	defer bolt.Close()
+
+	base := time.Unix(1661773286, 0).UTC()
+	for name, s := range map[string]Store{"in-memory": NewInMemoryStore(), "bolt": bolt} {
+		// inserted out of chronological order on purpose
+		var entries []entry
+		for _, hours := range []int{2, 0, 3, 1} {
+			e := entry{R: domain.NewRepost(
+				domain.NewPublication("platform/"+strconv.Itoa(hours), 10300, base),
+				base.Add(time.Duration(hours)*time.Hour),
+				domain.SuggestionRate(5),
+			)}
+			_ = s.insert(&e)
+			entries = append(entries, e)
+		}
+
+		if e, found := s.findByPublication("platform/3"); !found || e.Id != entries[2].Id {
+			t.Errorf("%s: expected to find entry %d by publication, got %v", name, entries[2].Id, e)
+		}
+		if _, found := s.findByPublication("platform/none"); found {
+			t.Errorf("%s: expected no entry of unknown publication", name)
+		}
+
+		_ = s.delete(entries[0])
+		if _, found := s.findByPublication("platform/2"); found {
+			t.Errorf("%s: expected deleted entry not to be found", name)
+		}
+
+		var ids []domain.PublicationId
+		s.walkRepostedBetween(base.Add(time.Hour), base.Add(3*time.Hour), func(e *entry) {
+			ids = append(ids, e.R.Pub.Id)
+		})
+		if !reflect.DeepEqual(ids, []domain.PublicationId{"platform/1"}) {
+			t.Errorf("%s: expected only platform/1 within the range after deleting platform/2, got %v", name, ids)
+		}
+
+		ids = nil
+		s.walkRepostedBetween(time.Time{}, time.Time{}, func(e *entry) {
+			ids = append(ids, e.R.Pub.Id)
+		})
+		if !reflect.DeepEqual(ids, []domain.PublicationId{"platform/0", "platform/1", "platform/3"}) {
+			t.Errorf("%s: expected all entries in chronological order with open bounds, got %v", name, ids)
+		}
+	}
+}
+
+func TestStoryLookups(t *testing.T) {
+	t.Parallel()
+
+	bolt, err := NewBoltStore(filepath.Join(t.TempDir(), "reposts.db"))
+	if err != nil {
+		t.Fatalf("NewBoltStore() threw an error: %v", err)
+	}
+	defer bolt.Close()
+
+	news := "The central bank raised the key rate to 12 percent at an unscheduled meeting on Tuesday morning"
+	for name, s := range map[string]Store{"in-memory": NewInMemoryStore(), "bolt": bolt} {
+		var entries []entry
+		for k, text := range []string{news, "Heavy snowfall is expected in the capital over the weekend, the weather service warns"} {
+			publication := domain.NewPublication("platform/"+strconv.Itoa(k), 10300, time.Now())
+			publication.Content.Text = text
+			e := entry{
+				R:     domain.NewRepost(publication, time.Now(), domain.SuggestionRate(5)),
+				Story: domain.NewStorySignature(publication),
+			}
+			_ = s.insert(&e)
+			entries = append(entries, e)
+		}
+
+		copied := domain.NewStorySignature(domain.Publication{Content: domain.Content{Text: "⚡️ " + news}})
+		var ids []domain.PublicationId
+		s.walkSharingStoryBands(copied.Bands(), func(e *entry) {
+			ids = append(ids, e.R.Pub.Id)
+		})
+		if !reflect.DeepEqual(ids, []domain.PublicationId{"platform/0"}) {
+			t.Errorf("%s: expected only the entry of the same story to share LSH bands, got %v", name, ids)
+		}
+
+		_ = s.delete(entries[0])
+		ids = nil
+		s.walkSharingStoryBands(copied.Bands(), func(e *entry) {
+			ids = append(ids, e.R.Pub.Id)
+		})
+		if len(ids) != 0 {
+			t.Errorf("%s: expected deleted entry not to be found by story, got %v", name, ids)
+		}
+	}
+}
+
+func TestMoveToDeadLetters(t *testing.T) {
+	t.Parallel()
+
+	bolt, err := NewBoltStore(filepath.Join(t.TempDir(), "reposts.db"))
+	if err != nil {
+		t.Fatalf("NewBoltStore() threw an error: %v", err)
+	}
+	defer bolt.Close()
+
+	for name, s := range map[string]Store{"in-memory": NewInMemoryStore(), "bolt": bolt} {
+		for _, id := range []string{"platform/1", "platform/2"} {
+			_ = s.insert(&entry{R: domain.NewRepost(domain.NewPublication(id, 10300, time.Now()), time.Now(), 5)})
+		}
+		e, _ := s.findByPublication("platform/1")
+		if err := s.moveToDeadLetters(*e); err != nil {
+			t.Errorf("%s: moveToDeadLetters() threw an error: %v", name, err)
+		}
+
+		if _, found := s.findByPublication("platform/1"); found || s.count() != 1 {
+			t.Errorf("%s: expected the dead letter gone from reposts, %d left", name, s.count())
+		}
+		// deleting what is already gone doesn't count twice
+		_ = s.delete(*e)
+		if s.count() != 1 {
+			t.Errorf("%s: expected 1 repost counted after deleting a missing one, got %d", name, s.count())
+		}
+		var dead []domain.PublicationId
+		s.walkDeadLetters(func(e *entry) {
+			dead = append(dead, e.R.Pub.Id)
+		})
+		if !reflect.DeepEqual(dead, []domain.PublicationId{"platform/1"}) {
+			t.Errorf("%s: got %v dead-lettered, want [platform/1]", name, dead)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package scraping
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterBurstAndRefill(t *testing.T) {
+	defer func(original func() time.Time) { now = original }(now)
+	currentTime := time.Unix(1661773286, 0)
+	now = func() time.Time { return currentTime }
+
+	limiter := NewRateLimiter(2, 3)
+
+	for i := 0; i < 3; i++ {
+		if delay := limiter.reserve(); delay != 0 {
+			t.Errorf("Request %d within burst must not wait, got %s", i+1, delay)
+		}
+	}
+	if delay := limiter.reserve(); delay != 500*time.Millisecond {
+		t.Errorf("Request beyond burst must wait for a token, got %s", delay)
+	}
+	if delay := limiter.reserve(); delay != time.Second {
+		t.Errorf("Next waiting request must line up after the previous one, got %s", delay)
+	}
+
+	currentTime = currentTime.Add(10 * time.Second)
+	if delay := limiter.reserve(); delay != 0 {
+		t.Errorf("Bucket must be refilled after idling, got %s", delay)
+	}
+}
+
+func TestNilRateLimiter(t *testing.T) {
+	t.Parallel()
+	if NewRateLimiter(0, 10) != nil {
+		t.Errorf("Zero rate must mean no limiter")
+	}
+	var limiter *RateLimiter
+	if err := limiter.Wait(context.Background()); err != nil {
+		t.Errorf("Nil limiter must never fail, got %v", err)
+	}
+}
+
+func TestRateLimiterGivesSlotBackOnCancel(t *testing.T) {
+	defer func(original func() time.Time) { now = original }(now)
+	currentTime := time.Unix(1661773286, 0)
+	now = func() time.Time { return currentTime }
+
+	limiter := NewRateLimiter(1, 1)
+	limiter.reserve()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := limiter.Wait(ctx); err == nil {
+		t.Errorf("Expected waiting to be cut short by the cancelled context")
+	}
+	if delay := limiter.reserve(); delay != time.Second {
+		t.Errorf("Cancelled reservation must not hold the slot, got delay %s", delay)
+	}
+}
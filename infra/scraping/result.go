@@ -0,0 +1,28 @@
+package scraping
+
+import (
+	"fmt"
+	"github.com/alexeyvy/tjlike-agenda/domain"
+)
+
+// ParseError describes a single publication that couldn't be parsed, the rest of the page is unaffected
+type ParseError struct {
+	Page          int
+	Index         int // position of the publication on the page
+	PublicationId string
+	Reason        string
+}
+
+func (e ParseError) Error() string {
+	if e.PublicationId == "" {
+		return fmt.Sprintf("publication #%d on page %d: %s", e.Index, e.Page, e.Reason)
+	}
+	return fmt.Sprintf("publication #%d (%s) on page %d: %s", e.Index, e.PublicationId, e.Page, e.Reason)
+}
+
+// Result holds publications that parsed fine along with those that didn't
+type Result struct {
+	Publications []domain.Publication
+	ParseErrors  []ParseError
+	Channel      domain.ChannelInfo
+}
@@ -0,0 +1,145 @@
+package scraping
+
+import (
+	"context"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var sleep = time.Sleep
+
+// HTTPStatusError carries the status code so that rate limiting can be told apart from a missing channel
+type HTTPStatusError struct {
+	StatusCode int
+	RetryAfter time.Duration
+}
+
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("HTTP request failed with status %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+func (e *HTTPStatusError) IsRateLimited() bool {
+	return e.StatusCode == http.StatusTooManyRequests
+}
+
+func (e *HTTPStatusError) retryable() bool {
+	switch e.StatusCode {
+	case http.StatusTooManyRequests,
+		http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// RetryPolicy defines how failed requests are repeated. Zero value means no retries
+type RetryPolicy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+func (p RetryPolicy) attempts() int {
+	if p.MaxAttempts < 1 {
+		return 1
+	}
+	return p.MaxAttempts
+}
+
+// backoff doubles the delay with every attempt and randomizes its second half so that channels don't retry in lockstep
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	delay := p.InitialBackoff
+	for i := 1; i < attempt; i++ {
+		delay *= 2
+		if p.MaxBackoff > 0 && delay >= p.MaxBackoff {
+			break
+		}
+	}
+	if p.MaxBackoff > 0 && delay > p.MaxBackoff {
+		delay = p.MaxBackoff
+	}
+	if delay <= 0 {
+		return 0
+	}
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(delay-half)+1))
+}
+
+// parseRetryAfter supports both forms of the header: delay in seconds and HTTP date
+func parseRetryAfter(header string) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(header); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Second * time.Duration(seconds)
+	}
+	if date, err := http.ParseTime(header); err == nil {
+		if delay := date.Sub(now()); delay > 0 {
+			return delay
+		}
+	}
+	return 0
+}
+
+// getWithRetry returns response with status 200 only, any other status is turned into HTTPStatusError.
+// Every attempt waits for the limiter first, nil limiter means no limit
+func getWithRetry(ctx context.Context, client *http.Client, limiter *RateLimiter, url string, policy RetryPolicy) (*http.Response, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("cannot build HTTP request: %w", err)
+	}
+	for attempt := 1; ; attempt++ {
+		var (
+			res        *http.Response
+			retryAfter time.Duration
+		)
+		if err := limiter.Wait(ctx); err != nil {
+			return nil, fmt.Errorf("gave up waiting for the rate limiter: %w", err)
+		}
+		res, err = client.Do(request)
+		if err != nil {
+			err = fmt.Errorf("HTTP request failed: %w", err)
+		} else if res.StatusCode == http.StatusOK {
+			return res, nil
+		} else {
+			statusErr := &HTTPStatusError{StatusCode: res.StatusCode}
+			if res.StatusCode == http.StatusTooManyRequests || res.StatusCode == http.StatusServiceUnavailable {
+				statusErr.RetryAfter = parseRetryAfter(res.Header.Get("Retry-After"))
+			}
+			res.Body.Close()
+			err = statusErr
+			if !statusErr.retryable() {
+				return nil, err
+			}
+			retryAfter = statusErr.RetryAfter
+		}
+
+		if attempt >= policy.attempts() {
+			break
+		}
+		delay := policy.backoff(attempt)
+		if retryAfter > delay {
+			delay = retryAfter
+			// the header comes from the server, so it must not stall the worker longer than the policy allows
+			if policy.MaxBackoff > 0 && delay > policy.MaxBackoff {
+				delay = policy.MaxBackoff
+			}
+		}
+		log.Debugf("Attempt %d of %d to fetch %s failed (%s), retrying in %s", attempt, policy.attempts(), url, err, delay)
+		sleep(delay)
+	}
+
+	if policy.attempts() > 1 {
+		return nil, fmt.Errorf("gave up after %d attempts: %w", policy.attempts(), err)
+	}
+	return nil, err
+}
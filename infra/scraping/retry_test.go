@@ -0,0 +1,110 @@
+package scraping
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRetryHonoursRetryAfter(t *testing.T) {
+	defer func(original func(time.Duration)) { sleep = original }(sleep)
+	var delays []time.Duration
+	sleep = func(d time.Duration) { delays = append(delays, d) }
+
+	type table struct {
+		maxBackoff time.Duration
+		wantDelay  time.Duration
+	}
+	tables := []table{
+		{maxBackoff: 5 * time.Minute, wantDelay: 120 * time.Second},
+		// Retry-After is capped by the policy
+		{maxBackoff: time.Minute, wantDelay: time.Minute},
+	}
+
+	for _, test := range tables {
+		delays = nil
+		var calls int
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			if calls == 1 {
+				w.Header().Set("Retry-After", "120")
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		}))
+
+		res, err := getWithRetry(context.Background(), server.Client(), nil, server.URL, RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Second, MaxBackoff: test.maxBackoff})
+		server.Close()
+		if err != nil {
+			t.Fatalf("getWithRetry() threw an error: %s", err)
+		}
+		res.Body.Close()
+		if calls != 2 {
+			t.Errorf("Expected 2 requests, got %d", calls)
+		}
+		if len(delays) != 1 || delays[0] != test.wantDelay {
+			t.Errorf("Expected single delay of %s with max backoff %s, got %v", test.wantDelay, test.maxBackoff, delays)
+		}
+	}
+}
+
+func TestRetryGivesUpWithStatusCode(t *testing.T) {
+	defer func(original func(time.Duration)) { sleep = original }(sleep)
+	sleep = func(d time.Duration) {}
+
+	type table struct {
+		status    int
+		wantCalls int
+	}
+	tables := []table{
+		{status: http.StatusServiceUnavailable, wantCalls: 3},
+		{status: http.StatusNotFound, wantCalls: 1},
+	}
+
+	for _, test := range tables {
+		var calls int
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			w.WriteHeader(test.status)
+		}))
+
+		_, err := getWithRetry(context.Background(), server.Client(), nil, server.URL, RetryPolicy{MaxAttempts: 3})
+		server.Close()
+
+		var statusErr *HTTPStatusError
+		if !errors.As(err, &statusErr) || statusErr.StatusCode != test.status {
+			t.Errorf("Expected HTTPStatusError with status %d, got %v", test.status, err)
+		}
+		if calls != test.wantCalls {
+			t.Errorf("Expected %d requests on status %d, got %d", test.wantCalls, test.status, calls)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	t.Parallel()
+	policy := RetryPolicy{InitialBackoff: 2 * time.Second, MaxBackoff: 10 * time.Second}
+
+	type table struct {
+		attempt int
+		min     time.Duration
+		max     time.Duration
+	}
+	tables := []table{
+		{attempt: 1, min: time.Second, max: 2 * time.Second},
+		{attempt: 2, min: 2 * time.Second, max: 4 * time.Second},
+		{attempt: 3, min: 4 * time.Second, max: 8 * time.Second},
+		{attempt: 10, min: 5 * time.Second, max: 10 * time.Second},
+	}
+
+	for _, test := range tables {
+		delay := policy.backoff(test.attempt)
+		if delay < test.min || delay > test.max {
+			t.Errorf("Backoff on attempt %d out of range, got: %s, want between %s and %s.", test.attempt, delay, test.min, test.max)
+		}
+	}
+}
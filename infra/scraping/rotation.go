@@ -0,0 +1,191 @@
+package scraping
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	RotationRoundRobin = "round_robin"
+	RotationRandom     = "random"
+)
+
+// RotationPolicy defines proxies and User-Agent strings requests are spread over
+type RotationPolicy struct {
+	Mode        string
+	Proxies     []string // http://, https:// or socks5:// URLs
+	UserAgents  []string
+	MaxFailures int           // consecutive failures before the proxy is taken out of rotation
+	Cooldown    time.Duration // how long the failing proxy stays out of rotation
+}
+
+type proxyState struct {
+	url                 *url.URL
+	transport           *http.Transport
+	consecutiveFailures int
+	totalRequests       int
+	totalFailures       int
+	cooldownUntil       time.Time
+}
+
+func (p *proxyState) available(at time.Time) bool {
+	return !at.Before(p.cooldownUntil)
+}
+
+type rotatingTransport struct {
+	mu         sync.Mutex
+	base       http.RoundTripper
+	policy     RotationPolicy
+	proxies    []*proxyState
+	nextProxy  int
+	nextAgent  int
+	userAgents []string
+}
+
+// NewRotatingTransport spreads requests over the proxies and User-Agent strings of the policy.
+// Each proxy gets its own copy of base so that connections are not shared between proxies
+func NewRotatingTransport(base *http.Transport, policy RotationPolicy) (http.RoundTripper, error) {
+	if base == nil {
+		base = http.DefaultTransport.(*http.Transport)
+	}
+	switch policy.Mode {
+	case "", RotationRoundRobin, RotationRandom:
+	default:
+		return nil, fmt.Errorf("unknown rotation mode %s", policy.Mode)
+	}
+	if len(policy.Proxies) == 0 && len(policy.UserAgents) == 0 {
+		return base, nil
+	}
+
+	t := &rotatingTransport{base: base, policy: policy, userAgents: policy.UserAgents}
+	for _, rawURL := range policy.Proxies {
+		proxyURL, err := url.Parse(rawURL)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse proxy URL: %w", err)
+		}
+		switch proxyURL.Scheme {
+		case "http", "https", "socks5", "socks5h":
+		default:
+			return nil, fmt.Errorf("unsupported proxy scheme %s of %s", proxyURL.Scheme, proxyURL.Redacted())
+		}
+		transport := base.Clone()
+		transport.Proxy = http.ProxyURL(proxyURL)
+		t.proxies = append(t.proxies, &proxyState{url: proxyURL, transport: transport})
+	}
+	return t, nil
+}
+
+func (t *rotatingTransport) pick(n int, next *int) int {
+	if t.policy.Mode == RotationRandom {
+		return rand.Intn(n)
+	}
+	picked := *next % n
+	*next = picked + 1
+	return picked
+}
+
+// pickProxy skips proxies under cooldown. If all of them are under cooldown, the one recovering first is used
+func (t *rotatingTransport) pickProxy() *proxyState {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	current := now()
+	available := make([]*proxyState, 0, len(t.proxies))
+	for _, proxy := range t.proxies {
+		if proxy.available(current) {
+			available = append(available, proxy)
+		}
+	}
+	if len(available) == 0 {
+		soonest := t.proxies[0]
+		for _, proxy := range t.proxies[1:] {
+			if proxy.cooldownUntil.Before(soonest.cooldownUntil) {
+				soonest = proxy
+			}
+		}
+		log.Warnf("All %d proxies are under cooldown, falling back to %s", len(t.proxies), soonest.url.Redacted())
+		return soonest
+	}
+	if t.policy.Mode == RotationRandom {
+		return available[rand.Intn(len(available))]
+	}
+	// round robin goes through the whole list so that recovered proxies get their turn
+	for {
+		proxy := t.proxies[t.pick(len(t.proxies), &t.nextProxy)]
+		if proxy.available(current) {
+			return proxy
+		}
+	}
+}
+
+func (t *rotatingTransport) pickUserAgent() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.userAgents[t.pick(len(t.userAgents), &t.nextAgent)]
+}
+
+func isProxyFailure(res *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	switch res.StatusCode {
+	case http.StatusForbidden,
+		http.StatusProxyAuthRequired,
+		http.StatusTooManyRequests,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+func (t *rotatingTransport) report(proxy *proxyState, failed bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	wasOutOfRotation := t.policy.MaxFailures > 0 && proxy.consecutiveFailures >= t.policy.MaxFailures
+	proxy.totalRequests++
+	if failed {
+		proxy.totalFailures++
+		proxy.consecutiveFailures++
+	} else {
+		proxy.consecutiveFailures = 0
+	}
+	logger := log.WithFields(log.Fields{
+		"proxy":    proxy.url.Redacted(),
+		"requests": proxy.totalRequests,
+		"failures": proxy.totalFailures,
+	})
+
+	switch {
+	case !failed && wasOutOfRotation:
+		logger.Info("Proxy is healthy again")
+	case failed && t.policy.MaxFailures > 0 && proxy.consecutiveFailures >= t.policy.MaxFailures:
+		proxy.cooldownUntil = now().Add(t.policy.Cooldown)
+		logger.Warnf("Proxy failed %d times in a row, taken out of rotation for %s", proxy.consecutiveFailures, t.policy.Cooldown)
+	case failed:
+		logger.Debugf("Proxy request failed, %d failures in a row", proxy.consecutiveFailures)
+	}
+}
+
+func (t *rotatingTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	if len(t.userAgents) > 0 {
+		// RoundTripper must not modify the original request
+		request = request.Clone(request.Context())
+		request.Header.Set("User-Agent", t.pickUserAgent())
+	}
+	if len(t.proxies) == 0 {
+		return t.base.RoundTrip(request)
+	}
+
+	proxy := t.pickProxy()
+	res, err := proxy.transport.RoundTrip(request)
+	t.report(proxy, isProxyFailure(res, err))
+	return res, err
+}
@@ -0,0 +1,80 @@
+package scraping
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRotationTakesFailingProxyOut(t *testing.T) {
+	currentTime := time.Unix(1661773286, 0)
+	defer func(original func() time.Time) { now = original }(now)
+	now = func() time.Time { return currentTime }
+
+	var (
+		mu         sync.Mutex
+		userAgents []string
+		healthyHit int
+		failingHit int
+	)
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		healthyHit++
+		userAgents = append(userAgents, r.UserAgent())
+	}))
+	defer healthy.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		failingHit++
+		userAgents = append(userAgents, r.UserAgent())
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+
+	transport, err := NewRotatingTransport(nil, RotationPolicy{
+		Mode:        RotationRoundRobin,
+		Proxies:     []string{failing.URL, healthy.URL},
+		UserAgents:  []string{"agent/1", "agent/2"},
+		MaxFailures: 1,
+		Cooldown:    time.Minute,
+	})
+	if err != nil {
+		t.Fatalf("NewRotatingTransport() threw an error: %s", err)
+	}
+	client := &http.Client{Transport: transport}
+
+	for i := 0; i < 4; i++ {
+		res, err := client.Get("http://t.me.invalid/s/channel")
+		if err != nil {
+			t.Fatalf("Request through proxy failed: %s", err)
+		}
+		res.Body.Close()
+	}
+	if failingHit != 1 || healthyHit != 3 {
+		t.Errorf("Failing proxy must be taken out of rotation after first failure, got %d failing and %d healthy hits", failingHit, healthyHit)
+	}
+	if userAgents[0] != "agent/1" || userAgents[1] != "agent/2" || userAgents[2] != "agent/1" {
+		t.Errorf("User agents are not rotated round robin, got %v", userAgents)
+	}
+
+	currentTime = currentTime.Add(2 * time.Minute)
+	res, _ := client.Get("http://t.me.invalid/s/channel")
+	res.Body.Close()
+	if failingHit != 2 {
+		t.Errorf("Failing proxy must be back in rotation after cooldown")
+	}
+}
+
+func TestRotationRejectsUnsupportedProxy(t *testing.T) {
+	t.Parallel()
+	if _, err := NewRotatingTransport(nil, RotationPolicy{Proxies: []string{"ftp://proxy.invalid"}}); err == nil {
+		t.Errorf("Expected an error on unsupported proxy scheme")
+	}
+	if _, err := NewRotatingTransport(nil, RotationPolicy{Mode: "sequential"}); err == nil {
+		t.Errorf("Expected an error on unknown rotation mode")
+	}
+}
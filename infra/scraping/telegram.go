@@ -1,84 +1,374 @@
 package scraping
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/PuerkitoBio/goquery"
 	"github.com/alexeyvy/tjlike-agenda/domain"
+	log "github.com/sirupsen/logrus"
+	"math"
 	"net/http"
+	"regexp"
 	"strconv"
+	"strings"
 	"time"
 )
 
+const DefaultTelegramBaseURL = "https://t.me/s"
+
 type TelegramScraper struct {
+	baseURL string
+	client  *http.Client
+	retry   RetryPolicy
+	limiter *RateLimiter
+}
+
+// NewTelegramScraper creates a scraper working against the given public preview base URL,
+// empty baseURL and nil client fall back to the defaults. Every request, retries and pagination included, waits for the limiter
+func NewTelegramScraper(baseURL string, client *http.Client, retry RetryPolicy, limiter *RateLimiter) *TelegramScraper {
+	return &TelegramScraper{baseURL: strings.TrimRight(baseURL, "/"), client: client, retry: retry, limiter: limiter}
+}
+
+func (s *TelegramScraper) url(channelId string) string {
+	baseURL := s.baseURL
+	if baseURL == "" {
+		baseURL = DefaultTelegramBaseURL
+	}
+	return fmt.Sprintf("%s/%s", baseURL, channelId)
+}
+
+func (s *TelegramScraper) httpClient() *http.Client {
+	if s.client == nil {
+		return http.DefaultClient
+	}
+	return s.client
+}
+
+const (
+	publicationsPerPage = 20
+	// safety net against endless pagination when depth is misconfigured
+	maxPages = 100
+)
+
+var now = time.Now
+
+// Depth defines how far back channel history is paginated. Zero value means only the first page is scraped.
+type Depth struct {
+	Publications int
+	MaxAge       time.Duration
 }
 
-const maxMsgNum = 20
+func (d Depth) isSinglePage() bool {
+	return d.Publications <= 0 && d.MaxAge <= 0
+}
+
+func (d Depth) satisfied(publications []domain.Publication) bool {
+	if d.isSinglePage() {
+		return true
+	}
+	if d.Publications > 0 && len(publications) >= d.Publications {
+		return true
+	}
+	if d.MaxAge > 0 && len(publications) > 0 && publications[0].PostedAt.Before(now().Add(-d.MaxAge)) {
+		return true
+	}
+	return false
+}
+
+// trim cuts publications (sorted from oldest to newest) off to fit the depth
+func (d Depth) trim(publications []domain.Publication) []domain.Publication {
+	if d.MaxAge > 0 {
+		cutoff := now().Add(-d.MaxAge)
+		for len(publications) > 0 && publications[0].PostedAt.Before(cutoff) {
+			publications = publications[1:]
+		}
+	}
+	if d.Publications > 0 && len(publications) > d.Publications {
+		publications = publications[len(publications)-d.Publications:]
+	}
+	return publications
+}
 
 type telegramPublication struct {
-	id         string
-	viewAmount string
-	postedAt   string
+	id            string
+	viewAmount    string
+	postedAt      string
+	text          string
+	html          string
+	photos        []string
+	videos        []string
+	links         []string
+	linkPreview   *domain.LinkPreview
+	forwardedFrom string
+	replyTo       string
+}
+
+var (
+	backgroundImagePattern = regexp.MustCompile(`background-image:\s*url\(['"]?([^'")]+)['"]?\)`)
+	hashtagPattern         = regexp.MustCompile(`#[\p{L}\p{N}_]+`)
+	replyToPattern         = regexp.MustCompile(`t\.me/(?:s/)?([^/?]+/\d+)`)
+)
+
+func backgroundImageURL(s *goquery.Selection) string {
+	style, _ := s.Attr("style")
+	matches := backgroundImagePattern.FindStringSubmatch(style)
+	if matches == nil {
+		return ""
+	}
+	return matches[1]
+}
+
+func extractHashtags(text string) []string {
+	return hashtagPattern.FindAllString(text, -1)
+}
+
+var viewNumberMultipliers = map[string]float64{
+	"K": 1e3,
+	"M": 1e6,
+	"B": 1e9,
 }
 
-func dehumanizeViewNumber(humanized string) int {
-	var viewAmount int
+// dehumanizeViewNumber turns view counters like "12.5K", "1,2K" or "1 234" into numbers, anything else is an error
+func dehumanizeViewNumber(humanized string) (int, error) {
+	// both regular and non-breaking spaces are used as thousands separators
+	normalized := strings.Map(func(r rune) rune {
+		if r == ' ' || r == '\u00a0' || r == '\u202f' {
+			return -1
+		}
+		return r
+	}, strings.TrimSpace(humanized))
+	if normalized == "" {
+		return 0, errors.New("view counter is empty")
+	}
+
+	multiplier, hasSuffix := viewNumberMultipliers[strings.ToUpper(normalized[len(normalized)-1:])]
+	if !hasSuffix {
+		viewAmount, err := strconv.Atoi(normalized)
+		if err != nil || viewAmount < 0 {
+			return 0, fmt.Errorf("unexpected view counter format %q", humanized)
+		}
+		return viewAmount, nil
+	}
 
-	switch humanized[len(humanized)-1:] {
-	case "K":
-		f, _ := strconv.ParseFloat(humanized[:len(humanized)-1], 64)
-		viewAmount = int(f * 1000)
-	case "M":
-		f, _ := strconv.ParseFloat(humanized[:len(humanized)-1], 64)
-		viewAmount = int(f * 1000000)
-	default:
-		viewAmount, _ = strconv.Atoi(humanized)
+	number := normalized[:len(normalized)-1]
+	// some locales use comma as a decimal separator
+	f, err := strconv.ParseFloat(strings.Replace(number, ",", ".", 1), 64)
+	if err != nil || f < 0 || math.IsInf(f, 0) || math.IsNaN(f) || strings.ContainsAny(number, "eE+-") {
+		return 0, fmt.Errorf("unexpected view counter format %q", humanized)
 	}
-	return viewAmount
+	return int(math.Round(f * multiplier)), nil
 }
 
 func (tm telegramPublication) generalize() domain.Publication {
 	postedAt, _ := time.Parse(time.RFC3339, tm.postedAt)
-	return domain.NewPublication(tm.id, dehumanizeViewNumber(tm.viewAmount), postedAt.UTC())
+	viewAmount, err := dehumanizeViewNumber(tm.viewAmount)
+	if err != nil {
+		log.Debugf("view amount of publication %s is unknown: %s", tm.id, err)
+		viewAmount = domain.UnknownViewAmount
+	}
+	publication := domain.NewPublication(tm.id, viewAmount, postedAt.UTC())
+	publication.Content = domain.Content{
+		Text:          tm.text,
+		HTML:          tm.html,
+		Photos:        tm.photos,
+		Videos:        tm.videos,
+		Links:         tm.links,
+		LinkPreview:   tm.linkPreview,
+		ForwardedFrom: tm.forwardedFrom,
+		ReplyTo:       domain.PublicationId(tm.replyTo),
+		Hashtags:      extractHashtags(tm.text),
+	}
+	return publication
+}
+
+// parseContent fills in the publication body from the message container, none of the parts is mandatory
+func (tm *telegramPublication) parseContent(s *goquery.Selection) {
+	textContainer := s.Find("div.tgme_widget_message_text.js-message_text").First()
+	if textContainer.Length() == 1 {
+		tm.text = strings.TrimSpace(textContainer.Text())
+		tm.html, _ = textContainer.Html()
+		textContainer.Find("a[href]").Each(func(i int, a *goquery.Selection) {
+			href, _ := a.Attr("href")
+			// hashtag and mention links are relative, they are not of interest
+			if strings.HasPrefix(href, "http") {
+				tm.links = append(tm.links, href)
+			}
+		})
+	}
+
+	s.Find("a.tgme_widget_message_photo_wrap").Each(func(i int, photo *goquery.Selection) {
+		if url := backgroundImageURL(photo); url != "" {
+			tm.photos = append(tm.photos, url)
+		}
+	})
+	s.Find(".tgme_widget_message_video_thumb").Each(func(i int, video *goquery.Selection) {
+		if url := backgroundImageURL(video); url != "" {
+			tm.videos = append(tm.videos, url)
+		}
+	})
+
+	previewContainer := s.Find("a.tgme_widget_message_link_preview").First()
+	if previewContainer.Length() == 1 {
+		href, _ := previewContainer.Attr("href")
+		tm.linkPreview = &domain.LinkPreview{
+			URL:         href,
+			SiteName:    strings.TrimSpace(previewContainer.Find(".link_preview_site_name").Text()),
+			Title:       strings.TrimSpace(previewContainer.Find(".link_preview_title").Text()),
+			Description: strings.TrimSpace(previewContainer.Find(".link_preview_description").Text()),
+			ImageURL:    backgroundImageURL(previewContainer.Find(".link_preview_image, .link_preview_right_image").First()),
+		}
+	}
+
+	tm.forwardedFrom = strings.TrimSpace(s.Find(".tgme_widget_message_forwarded_from_name").First().Text())
+
+	replyContainer := s.Find("a.tgme_widget_message_reply").First()
+	if href, exists := replyContainer.Attr("href"); exists {
+		if matches := replyToPattern.FindStringSubmatch(href); matches != nil {
+			tm.replyTo = matches[1]
+		}
+	}
 }
 
-func (s *TelegramScraper) ScrapeRecentPublications(channel domain.Channel) ([]domain.Publication, error) {
-	unformattedPublications, err := s.scrapeRecentPublications(channel.Id)
+// messageNumber extracts sequential message number out of publication ID like "channel/123"
+func messageNumber(id domain.PublicationId) (int, bool) {
+	separatorPos := strings.LastIndex(string(id), "/")
+	if separatorPos == -1 {
+		return 0, false
+	}
+	number, err := strconv.Atoi(string(id)[separatorPos+1:])
 	if err != nil {
-		return nil, err
+		return 0, false
+	}
+	return number, true
+}
+
+func oldestMessageNumber(publications []domain.Publication) (int, bool) {
+	var (
+		oldest int
+		found  bool
+	)
+	for _, publication := range publications {
+		number, ok := messageNumber(publication.Id)
+		if !ok {
+			continue
+		}
+		if !found || number < oldest {
+			oldest = number
+			found = true
+		}
+	}
+	return oldest, found
+}
+
+// ScrapeRecentPublications fails only if the channel can't be scraped at all,
+// publications that can't be parsed are reported in the result
+func (s *TelegramScraper) ScrapeRecentPublications(channel domain.Channel, depth Depth) (Result, error) {
+	formattedPublications := make([]domain.Publication, 0, publicationsPerPage)
+	var (
+		parseErrors []ParseError
+		channelInfo domain.ChannelInfo
+	)
+	before := 0
+
+	for page := 0; page < maxPages; page++ {
+		scrapedPage, err := s.scrapeRecentPublications(channel.Id, before)
+		if err != nil {
+			if page == 0 {
+				return Result{}, err
+			}
+			log.Warnf("pagination stopped on channel %s at page %d: %s", channel.Id, page, err.Error())
+			break
+		}
+		if page == 0 {
+			channelInfo = scrapedPage.channel
+		}
+		for _, parseError := range scrapedPage.parseErrors {
+			parseError.Page = page
+			parseErrors = append(parseErrors, parseError)
+		}
+
+		pagePublications := make([]domain.Publication, 0, len(scrapedPage.publications))
+		for publicationKey := range scrapedPage.publications {
+			publication := scrapedPage.publications[publicationKey].generalize()
+			publication.ChannelId = channel.Id
+			pagePublications = append(pagePublications, publication)
+		}
+		// older pages go first so that publications keep chronological order
+		formattedPublications = append(pagePublications, formattedPublications...)
+
+		if depth.satisfied(formattedPublications) {
+			break
+		}
+		oldest, found := oldestMessageNumber(pagePublications)
+		if !found || oldest <= 1 || (before != 0 && oldest >= before) {
+			break
+		}
+		before = oldest
 	}
 
-	formattedPublications := make([]domain.Publication, 0, maxMsgNum)
-	for publicationKey := range unformattedPublications {
-		formattedPublications = append(formattedPublications, unformattedPublications[publicationKey].generalize())
+	return Result{Publications: depth.trim(formattedPublications), ParseErrors: parseErrors, Channel: channelInfo}, nil
+}
+
+type telegramPage struct {
+	publications []telegramPublication
+	parseErrors  []ParseError
+	channel      domain.ChannelInfo
+}
+
+// parseChannelInfo reads the channel header, subscriber count stays unknown if the header is missing
+func parseChannelInfo(channelId string, doc *goquery.Document) domain.ChannelInfo {
+	info := domain.NewChannelInfo(channelId)
+	header := doc.Find(".tgme_channel_info").First()
+	if header.Length() == 0 {
+		return info
 	}
-	return formattedPublications, nil
+
+	info.Title = strings.TrimSpace(header.Find(".tgme_channel_info_header_title").Text())
+	info.Description = strings.TrimSpace(header.Find(".tgme_channel_info_description").Text())
+	info.AvatarURL, _ = header.Find(".tgme_page_photo_image img").Attr("src")
+	header.Find(".tgme_channel_info_counter").EachWithBreak(func(i int, counter *goquery.Selection) bool {
+		counterType := strings.TrimSpace(counter.Find(".counter_type").Text())
+		if !strings.HasPrefix(counterType, "subscriber") {
+			return true
+		}
+		subscribers, err := dehumanizeViewNumber(counter.Find(".counter_value").Text())
+		if err != nil {
+			log.Debugf("subscriber count of channel %s is unknown: %s", channelId, err)
+			return false
+		}
+		info.Subscribers = subscribers
+		return false
+	})
+	return info
 }
 
-func (s *TelegramScraper) scrapeRecentPublications(channelId string) ([]telegramPublication, error) {
-	url := fmt.Sprintf("https://t.me/s/%s", channelId)
-	res, err := http.Get(url)
+func (s *TelegramScraper) scrapeRecentPublications(channelId string, before int) (telegramPage, error) {
+	url := s.url(channelId)
+	if before > 0 {
+		url += fmt.Sprintf("?before=%d", before)
+	}
+	res, err := getWithRetry(context.Background(), s.httpClient(), s.limiter, url, s.retry)
 	if err != nil {
-		return nil, fmt.Errorf("HTTP request failed: %w", err)
+		return telegramPage{}, err
 	}
 	defer res.Body.Close()
-	if res.StatusCode != 200 {
-		return nil, errors.New("HTTP request failed")
-	}
 
 	doc, err := goquery.NewDocumentFromReader(res.Body)
 	if err != nil {
-		return nil, fmt.Errorf("cannot parse HTTP response: %w", err)
+		return telegramPage{}, fmt.Errorf("cannot parse HTTP response: %w", err)
 	}
 
-	var publications []telegramPublication
+	var (
+		publications []telegramPublication
+		parseErrors  []ParseError
+	)
 
 	container := doc.Find("div.tgme_widget_message_wrap")
 	if container.Length() == 0 {
-		return nil, errors.New("no publications found in div.tgme_widget_message_wrap. this may be private or non-existent channel")
+		return telegramPage{}, errors.New("no publications found in div.tgme_widget_message_wrap. this may be private or non-existent channel")
 	}
 
-	var e error
 	container.Each(func(i int, s *goquery.Selection) {
 		idContainer := s.Find("div.tgme_widget_message")
 		var id string
@@ -86,11 +376,11 @@ func (s *TelegramScraper) scrapeRecentPublications(channelId string) ([]telegram
 			var exists bool
 			id, exists = idContainer.Attr("data-post")
 			if !exists {
-				e = fmt.Errorf("one of publications has no ID")
+				parseErrors = append(parseErrors, ParseError{Index: i, Reason: "publication has no ID"})
 				return
 			}
 		} else {
-			e = fmt.Errorf("container ID not found")
+			parseErrors = append(parseErrors, ParseError{Index: i, Reason: "container ID not found"})
 			return
 		}
 
@@ -107,19 +397,18 @@ func (s *TelegramScraper) scrapeRecentPublications(channelId string) ([]telegram
 			var exists bool
 			postedAt, exists = postedAtContainer.Attr("datetime")
 			if !exists {
-				e = fmt.Errorf("one of publications has no POSTED AT")
+				parseErrors = append(parseErrors, ParseError{Index: i, PublicationId: id, Reason: "publication has no POSTED AT"})
 				return
 			}
 		} else {
-			e = fmt.Errorf("container POSTED AT not found")
+			parseErrors = append(parseErrors, ParseError{Index: i, PublicationId: id, Reason: "container POSTED AT not found"})
 			return
 		}
 
-		publications = append(publications, telegramPublication{id: id, viewAmount: viewAmount, postedAt: postedAt})
+		publication := telegramPublication{id: id, viewAmount: viewAmount, postedAt: postedAt}
+		publication.parseContent(s)
+		publications = append(publications, publication)
 	})
-	if e != nil {
-		return publications, e
-	}
 
-	return publications, nil
+	return telegramPage{publications, parseErrors, parseChannelInfo(channelId, doc)}, nil
 }
@@ -1,14 +1,24 @@
 package scraping
 
 import (
+	"github.com/PuerkitoBio/goquery"
+	"github.com/alexeyvy/tjlike-agenda/domain"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestDehumanitizeViewNumber(t *testing.T) {
 	t.Parallel()
 	type table struct {
-		input string
-		want  int
+		input   string
+		want    int
+		wantErr bool
 	}
 
 	tables := []table{
@@ -19,20 +29,49 @@ func TestDehumanitizeViewNumber(t *testing.T) {
 		{input: "0M", want: 0},
 		{input: "0", want: 0},
 		{input: "55", want: 55},
+		{input: "1,2K", want: 1200},
+		{input: "1.2B", want: 1200000000},
+		{input: "3.3k", want: 3300},
+		{input: "987 ", want: 987},
+		{input: "1\u00a0234", want: 1234},
+		{input: "", wantErr: true},
+		{input: " ", wantErr: true},
+		{input: "K", wantErr: true},
+		{input: "1,234", wantErr: true},
+		{input: "-5", wantErr: true},
+		{input: "1e3K", wantErr: true},
+		{input: "many", wantErr: true},
+		{input: "InfK", wantErr: true},
 	}
 
 	for _, test := range tables {
-		result := dehumanizeViewNumber(test.input)
+		result, err := dehumanizeViewNumber(test.input)
 
-		if result != test.want {
-			t.Errorf("Dehumanized incorrectly on input %s, got: %d, want: %d.", test.input, result, test.want)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("Expected an error on input %q, got: %d.", test.input, result)
+			}
+			continue
+		}
+		if err != nil || result != test.want {
+			t.Errorf("Dehumanized incorrectly on input %q, got: %d (%v), want: %d.", test.input, result, err, test.want)
 		}
 	}
 }
 
+func TestUnknownViewAmount(t *testing.T) {
+	t.Parallel()
+	tm := telegramPublication{id: "tg/msgid", viewAmount: "", postedAt: "2022-08-29T11:41:26+00:00"}
+	generalized := tm.generalize()
+
+	if generalized.ViewsKnown() {
+		t.Errorf("Publication with unreadable view counter must have unknown view amount, got %d", generalized.ViewAmount)
+	}
+}
+
 func TestConvertTgPublicationToAbstractPublication(t *testing.T) {
 	t.Parallel()
-	tm := telegramPublication{"tg/msgid", "10.5K", "2022-08-29T11:41:26+00:00"}
+	tm := telegramPublication{id: "tg/msgid", viewAmount: "10.5K", postedAt: "2022-08-29T11:41:26+00:00"}
 	generalized := tm.generalize()
 
 	if generalized.PostedAt.String() != "2022-08-29 11:41:26 +0000 UTC" {
@@ -43,3 +82,236 @@ func TestConvertTgPublicationToAbstractPublication(t *testing.T) {
 		)
 	}
 }
+
+func TestMessageNumber(t *testing.T) {
+	t.Parallel()
+	type table struct {
+		input  domain.PublicationId
+		want   int
+		wantOk bool
+	}
+
+	tables := []table{
+		{input: "channel/123", want: 123, wantOk: true},
+		{input: "channel/1", want: 1, wantOk: true},
+		{input: "channel", want: 0, wantOk: false},
+		{input: "channel/abc", want: 0, wantOk: false},
+	}
+
+	for _, test := range tables {
+		result, ok := messageNumber(test.input)
+
+		if result != test.want || ok != test.wantOk {
+			t.Errorf("Message number extracted incorrectly on input %s, got: %d %t, want: %d %t.", test.input, result, ok, test.want, test.wantOk)
+		}
+	}
+}
+
+func TestDepthTrim(t *testing.T) {
+	currentTime, _ := time.Parse(time.RFC3339, "2022-08-29T12:00:00+00:00")
+	defer func(original func() time.Time) { now = original }(now)
+	now = func() time.Time { return currentTime }
+
+	publications := []domain.Publication{
+		domain.NewPublication("tg/1", 100, currentTime.Add(-5*time.Hour)),
+		domain.NewPublication("tg/2", 100, currentTime.Add(-3*time.Hour)),
+		domain.NewPublication("tg/3", 100, currentTime.Add(-2*time.Hour)),
+		domain.NewPublication("tg/4", 100, currentTime.Add(-1*time.Hour)),
+	}
+
+	trimmed := Depth{MaxAge: 4 * time.Hour}.trim(publications)
+	if len(trimmed) != 3 || trimmed[0].Id != "tg/2" {
+		t.Errorf("Age trimming failed, got %d publications", len(trimmed))
+	}
+	trimmed = Depth{Publications: 2}.trim(publications)
+	if len(trimmed) != 2 || trimmed[0].Id != "tg/3" {
+		t.Errorf("Count trimming failed, got %d publications", len(trimmed))
+	}
+	if !(Depth{}).satisfied(publications[3:]) {
+		t.Errorf("Zero depth must be satisfied by the first page")
+	}
+	if (Depth{Publications: 10}).satisfied(publications) {
+		t.Errorf("Depth of 10 publications must not be satisfied by 4 publications")
+	}
+	if !(Depth{MaxAge: 4 * time.Hour}).satisfied(publications) {
+		t.Errorf("Age depth must be satisfied once the oldest publication is beyond the window")
+	}
+}
+
+func TestParseContent(t *testing.T) {
+	t.Parallel()
+	html := `<div class="tgme_widget_message_wrap"><div class="tgme_widget_message" data-post="tg/2">
+<div class="tgme_widget_message_forwarded_from">Forwarded from <a class="tgme_widget_message_forwarded_from_name" href="https://t.me/source">Source</a></div>
+<a class="tgme_widget_message_reply" href="https://t.me/tg/1"><div class="tgme_widget_message_text js-message_reply_text">Replied</div></a>
+<a class="tgme_widget_message_photo_wrap" style="width:100px;background-image:url('https://cdn.example/photo.jpg')"></a>
+<i class="tgme_widget_message_video_thumb" style="background-image:url('https://cdn.example/video.jpg')"></i>
+<div class="tgme_widget_message_text js-message_text">Breaking <a href="?q=%23news">#news</a> at <a href="https://example.com/article">example.com</a></div>
+<a class="tgme_widget_message_link_preview" href="https://example.com/article">
+<div class="link_preview_site_name">Example</div><div class="link_preview_title">Article</div>
+<div class="link_preview_description">Description</div><i class="link_preview_image" style="background-image:url('https://cdn.example/preview.jpg')"></i>
+</a></div></div>`
+	doc, _ := goquery.NewDocumentFromReader(strings.NewReader(html))
+	tm := telegramPublication{id: "tg/2", viewAmount: "1K", postedAt: "2022-08-29T11:41:26+00:00"}
+	tm.parseContent(doc.Find("div.tgme_widget_message_wrap"))
+	content := tm.generalize().Content
+
+	if content.Text != "Breaking #news at example.com" {
+		t.Errorf("Text parsed incorrectly, got %s", content.Text)
+	}
+	if len(content.Hashtags) != 1 || content.Hashtags[0] != "#news" {
+		t.Errorf("Hashtags parsed incorrectly, got %v", content.Hashtags)
+	}
+	if len(content.Links) != 1 || content.Links[0] != "https://example.com/article" {
+		t.Errorf("Links parsed incorrectly, got %v", content.Links)
+	}
+	if len(content.Photos) != 1 || content.Photos[0] != "https://cdn.example/photo.jpg" {
+		t.Errorf("Photos parsed incorrectly, got %v", content.Photos)
+	}
+	if len(content.Videos) != 1 || content.Videos[0] != "https://cdn.example/video.jpg" {
+		t.Errorf("Videos parsed incorrectly, got %v", content.Videos)
+	}
+	if content.LinkPreview == nil || content.LinkPreview.Title != "Article" || content.LinkPreview.ImageURL != "https://cdn.example/preview.jpg" {
+		t.Errorf("Link preview parsed incorrectly, got %v", content.LinkPreview)
+	}
+	if content.ForwardedFrom != "Source" {
+		t.Errorf("Forwarded from parsed incorrectly, got %s", content.ForwardedFrom)
+	}
+	if content.ReplyTo != "tg/1" {
+		t.Errorf("Reply to parsed incorrectly, got %s", content.ReplyTo)
+	}
+}
+
+// newFixtureServer serves saved t.me pages from testdata/telegram, "/<channel>?before=<n>" maps to <channel>_before_<n>.html
+func newFixtureServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.Trim(r.URL.Path, "/")
+		if before := r.URL.Query().Get("before"); before != "" {
+			name += "_before_" + before
+		}
+		page, err := os.ReadFile(filepath.Join("testdata", "telegram", name+".html"))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write(page)
+	}))
+}
+
+func TestScrapeFixturePage(t *testing.T) {
+	t.Parallel()
+	server := newFixtureServer()
+	defer server.Close()
+
+	s := NewTelegramScraper(server.URL, server.Client(), RetryPolicy{}, nil)
+	result, err := s.ScrapeRecentPublications(domain.NewChannel("fixture"), Depth{})
+	if err != nil {
+		t.Fatalf("ScrapeRecentPublications() threw an error: %s", err)
+	}
+	publications := result.Publications
+	// service message and the one with no views yet are skipped
+	if len(publications) != 2 {
+		t.Fatalf("Expected 2 publications, got %d", len(publications))
+	}
+	album := publications[0]
+	if album.Id != "fixture/11" || album.ViewAmount != 1200 {
+		t.Errorf("Album parsed incorrectly, got %s with %d views", album.Id, album.ViewAmount)
+	}
+	if len(album.Content.Photos) != 2 {
+		t.Errorf("Expected 2 photos in the album, got %d", len(album.Content.Photos))
+	}
+	if album.ChannelId != "fixture" {
+		t.Errorf("Publication must refer to its channel, got %s", album.ChannelId)
+	}
+	forwarded := publications[1]
+	if forwarded.Id != "fixture/14" || forwarded.Content.ForwardedFrom != "Source" || forwarded.Content.LinkPreview == nil {
+		t.Errorf("Forwarded publication parsed incorrectly, got %+v", forwarded)
+	}
+}
+
+func TestScrapeFixtureChannelInfo(t *testing.T) {
+	t.Parallel()
+	server := newFixtureServer()
+	defer server.Close()
+
+	s := NewTelegramScraper(server.URL, server.Client(), RetryPolicy{}, nil)
+	result, err := s.ScrapeRecentPublications(domain.NewChannel("fixture"), Depth{})
+	if err != nil {
+		t.Fatalf("ScrapeRecentPublications() threw an error: %s", err)
+	}
+	want := domain.ChannelInfo{
+		Id:          "fixture",
+		Title:       "Fixture Channel",
+		Description: "Saved page for offline tests",
+		AvatarURL:   "https://cdn.example/avatar.jpg",
+		Subscribers: 1230000,
+	}
+	if result.Channel != want {
+		t.Errorf("Channel info parsed incorrectly, got %+v, want %+v", result.Channel, want)
+	}
+
+	result, err = s.ScrapeRecentPublications(domain.NewChannel("missing_date"), Depth{})
+	if err != nil {
+		t.Fatalf("ScrapeRecentPublications() threw an error: %s", err)
+	}
+	if result.Channel.SubscribersKnown() {
+		t.Errorf("Subscriber count must be unknown when the channel header is missing")
+	}
+}
+
+func TestScrapeFixturePagination(t *testing.T) {
+	t.Parallel()
+	server := newFixtureServer()
+	defer server.Close()
+
+	s := NewTelegramScraper(server.URL, server.Client(), RetryPolicy{}, nil)
+	result, err := s.ScrapeRecentPublications(domain.NewChannel("fixture"), Depth{Publications: 4})
+	if err != nil {
+		t.Fatalf("ScrapeRecentPublications() threw an error: %s", err)
+	}
+	publications := result.Publications
+	ids := make([]domain.PublicationId, 0, len(publications))
+	for _, publication := range publications {
+		ids = append(ids, publication.Id)
+	}
+	want := []domain.PublicationId{"fixture/8", "fixture/9", "fixture/11", "fixture/14"}
+	if !reflect.DeepEqual(ids, want) {
+		t.Errorf("Expected publications %v in chronological order, got %v", want, ids)
+	}
+	if publications[0].Content.ReplyTo != "fixture/7" {
+		t.Errorf("Reply to parsed incorrectly, got %s", publications[0].Content.ReplyTo)
+	}
+	if len(publications[1].Content.Videos) != 1 {
+		t.Errorf("Expected 1 video thumbnail, got %d", len(publications[1].Content.Videos))
+	}
+}
+
+func TestScrapeFixtureMissingDate(t *testing.T) {
+	t.Parallel()
+	server := newFixtureServer()
+	defer server.Close()
+
+	s := NewTelegramScraper(server.URL, server.Client(), RetryPolicy{}, nil)
+	result, err := s.ScrapeRecentPublications(domain.NewChannel("missing_date"), Depth{})
+	if err != nil {
+		t.Fatalf("Publication without POSTED AT must not fail the whole channel, got %s", err)
+	}
+	if len(result.Publications) != 1 || result.Publications[0].Id != "missing_date/1" {
+		t.Errorf("Expected the dated publication to be returned, got %d publications", len(result.Publications))
+	}
+	if len(result.ParseErrors) != 1 || result.ParseErrors[0].Index != 1 || result.ParseErrors[0].PublicationId != "missing_date/2" {
+		t.Errorf("Expected a parse error for the second publication, got %v", result.ParseErrors)
+	}
+}
+
+func TestScrapeFixtureUnavailableChannel(t *testing.T) {
+	t.Parallel()
+	server := newFixtureServer()
+	defer server.Close()
+
+	s := NewTelegramScraper(server.URL, server.Client(), RetryPolicy{}, nil)
+	for _, channelId := range []string{"private", "non_existent"} {
+		if _, err := s.ScrapeRecentPublications(domain.NewChannel(channelId), Depth{}); err == nil {
+			t.Errorf("Expected an error on channel %s", channelId)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package snapshot
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/alexeyvy/tjlike-agenda/domain"
+	"os"
+	"sync"
+	"time"
+)
+
+var now = time.Now
+
+// Retention limits how much history is kept, zero values mean no limit
+type Retention struct {
+	MaxAge     time.Duration
+	MaxSamples int // per publication
+}
+
+// series only keeps what is needed to tell the publication apart when replayed, content is never stored
+type series struct {
+	ChannelId string
+	PostedAt  time.Time
+	Samples   []sample
+}
+
+func (s *series) publication(id domain.PublicationId) domain.Publication {
+	publication := domain.NewPublication(string(id), domain.UnknownViewAmount, s.PostedAt)
+	publication.ChannelId = s.ChannelId
+	if len(s.Samples) > 0 {
+		publication.ViewAmount = s.Samples[len(s.Samples)-1].ViewAmount
+	}
+	return publication
+}
+
+// sample is serialized as [unix seconds, views] to keep the file compact
+type sample domain.ViewSample
+
+func (s sample) MarshalJSON() ([]byte, error) {
+	return json.Marshal([2]int64{s.ObservedAt.Unix(), int64(s.ViewAmount)})
+}
+
+func (s *sample) UnmarshalJSON(data []byte) error {
+	var pair [2]int64
+	if err := json.Unmarshal(data, &pair); err != nil {
+		return err
+	}
+	s.ObservedAt = time.Unix(pair[0], 0).UTC()
+	s.ViewAmount = int(pair[1])
+	return nil
+}
+
+// Store keeps view samples of every scraped publication across traversals
+type Store struct {
+	series    map[domain.PublicationId]*series
+	retention Retention
+	path      string
+	sync.RWMutex
+}
+
+func NewInMemoryStore(retention Retention) *Store {
+	return &Store{series: make(map[domain.PublicationId]*series), retention: retention}
+}
+
+// NewFileStore creates a store which is persisted to the given path on Push
+func NewFileStore(path string, retention Retention) *Store {
+	s := NewInMemoryStore(retention)
+	s.path = path
+	return s
+}
+
+// Record adds a sample for each publication with known views, retention is up to ApplyRetention
+func (s *Store) Record(publications []domain.Publication, observedAt time.Time) {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, publication := range publications {
+		if !publication.ViewsKnown() {
+			continue
+		}
+		ser, found := s.series[publication.Id]
+		if !found {
+			ser = &series{}
+			s.series[publication.Id] = ser
+		}
+		ser.ChannelId = publication.ChannelId
+		ser.PostedAt = publication.PostedAt
+		ser.Samples = append(ser.Samples, sample{ViewAmount: publication.ViewAmount, ObservedAt: observedAt})
+	}
+}
+
+// ApplyRetention drops samples beyond retention, meant to be called once per traversal rather than on every Record
+func (s *Store) ApplyRetention() {
+	s.Lock()
+	defer s.Unlock()
+
+	s.applyRetention()
+}
+
+func (s *Store) applyRetention() {
+	var threshold time.Time
+	if s.retention.MaxAge > 0 {
+		threshold = now().Add(-s.retention.MaxAge)
+	}
+	for id, ser := range s.series {
+		samples := ser.Samples
+		for len(samples) > 0 && samples[0].ObservedAt.Before(threshold) {
+			samples = samples[1:]
+		}
+		if s.retention.MaxSamples > 0 && len(samples) > s.retention.MaxSamples {
+			samples = samples[len(samples)-s.retention.MaxSamples:]
+		}
+		if len(samples) == 0 {
+			delete(s.series, id)
+			continue
+		}
+		// copy so that the dropped samples don't stay referenced by the underlying array
+		ser.Samples = append(make([]sample, 0, len(samples)), samples...)
+	}
+}
+
+func (s *Store) Samples(id domain.PublicationId) []domain.ViewSample {
+	s.RLock()
+	defer s.RUnlock()
+
+	ser, found := s.series[id]
+	if !found {
+		return nil
+	}
+	samples := make([]domain.ViewSample, len(ser.Samples))
+	for k, smp := range ser.Samples {
+		samples[k] = domain.ViewSample(smp)
+	}
+	return samples
+}
+
+// Velocity is views gained per minute since the previous sample of the publication
+func (s *Store) Velocity(id domain.PublicationId) (float64, bool) {
+	return domain.Velocity(s.Samples(id))
+}
+
+// Walk visits every recorded publication along with its samples, in no particular order.
+// Publications only carry ID, channel, posting moment and the latest views, as content isn't recorded
+func (s *Store) Walk(handle func(publication domain.Publication, samples []domain.ViewSample)) {
+	s.RLock()
+	defer s.RUnlock()
+
+	for id, ser := range s.series {
+		samples := make([]domain.ViewSample, len(ser.Samples))
+		for k, smp := range ser.Samples {
+			samples[k] = domain.ViewSample(smp)
+		}
+		handle(ser.publication(id), samples)
+	}
+}
+
+var ErrNotInited = errors.New("cannot initialize snapshot store as the source does not exist")
+
+func (s *Store) Pull() error {
+	if s.path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return ErrNotInited
+	}
+	if err != nil {
+		return fmt.Errorf("cannot read snapshot file: %w", err)
+	}
+	loaded := make(map[domain.PublicationId]*series)
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		return fmt.Errorf("cannot unmarshal snapshots: %w", err)
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	s.series = loaded
+	s.applyRetention()
+	return nil
+}
+
+func (s *Store) Push() error {
+	if s.path == "" {
+		return nil
+	}
+	s.RLock()
+	jsonEncoded, err := json.Marshal(s.series)
+	s.RUnlock()
+	if err != nil {
+		return fmt.Errorf("cannot marshal snapshots: %w", err)
+	}
+	// written aside, synced and renamed, so that a crash in the middle of writing doesn't corrupt the file
+	tmpPath := s.path + ".tmp"
+	if err := writeSynced(tmpPath, jsonEncoded); err != nil {
+		return fmt.Errorf("cannot write snapshot file: %w", err)
+	}
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		return fmt.Errorf("cannot replace snapshot file: %w", err)
+	}
+	return nil
+}
+
+func writeSynced(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,91 @@
+package snapshot
+
+import (
+	"github.com/alexeyvy/tjlike-agenda/domain"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRecordAndVelocity(t *testing.T) {
+	t.Parallel()
+	s := NewInMemoryStore(Retention{})
+	observedAt := time.Unix(1661773286, 0).UTC()
+
+	s.Record([]domain.Publication{domain.NewPublication("platform/id", 1000, observedAt)}, observedAt)
+	if _, ok := s.Velocity("platform/id"); ok {
+		t.Errorf("Velocity must be unknown with a single sample")
+	}
+
+	s.Record([]domain.Publication{
+		domain.NewPublication("platform/id", 1600, observedAt),
+		domain.NewPublication("platform/id2", domain.UnknownViewAmount, observedAt),
+	}, observedAt.Add(10*time.Minute))
+	velocity, ok := s.Velocity("platform/id")
+	if !ok || velocity != 60 {
+		t.Errorf("Expected velocity of 60 views per minute, got %f", velocity)
+	}
+	if len(s.Samples("platform/id2")) != 0 {
+		t.Errorf("Publication with unknown views must not be recorded")
+	}
+}
+
+func TestRetention(t *testing.T) {
+	defer func(original func() time.Time) { now = original }(now)
+	currentTime := time.Unix(1661773286, 0).UTC()
+	now = func() time.Time { return currentTime }
+
+	s := NewInMemoryStore(Retention{MaxAge: 2 * time.Hour, MaxSamples: 2})
+	for i := 0; i < 4; i++ {
+		s.Record([]domain.Publication{domain.NewPublication("platform/id", 1000*i, currentTime)}, currentTime.Add(time.Duration(i-3)*time.Hour))
+	}
+	if samples := s.Samples("platform/id"); len(samples) != 4 {
+		t.Errorf("Expected retention to wait until applied, got %v", samples)
+	}
+	s.ApplyRetention()
+	samples := s.Samples("platform/id")
+	if len(samples) != 2 || samples[0].ViewAmount != 2000 {
+		t.Errorf("Expected 2 latest samples to be kept, got %v", samples)
+	}
+
+	currentTime = currentTime.Add(3 * time.Hour)
+	s.ApplyRetention()
+	if samples := s.Samples("platform/id"); samples != nil {
+		t.Errorf("Expected outdated series to be dropped, got %v", samples)
+	}
+}
+
+func TestFileRoundTrip(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "snapshots.txt")
+	observedAt := time.Unix(1661773286, 0).UTC()
+
+	s := NewFileStore(path, Retention{})
+	if err := s.Pull(); err != ErrNotInited {
+		t.Errorf("Expected ErrNotInited on missing file, got %v", err)
+	}
+	publication := domain.NewPublication("platform/id", 1000, observedAt.Add(-time.Hour))
+	publication.ChannelId = "platform"
+	publication.Content.Text = "Not to be recorded"
+	s.Record([]domain.Publication{publication}, observedAt)
+	if err := s.Push(); err != nil {
+		t.Fatalf("Push() threw an error: %s", err)
+	}
+
+	loaded := NewFileStore(path, Retention{})
+	if err := loaded.Pull(); err != nil {
+		t.Fatalf("Pull() threw an error: %s", err)
+	}
+	samples := loaded.Samples("platform/id")
+	if len(samples) != 1 || samples[0].ViewAmount != 1000 || !samples[0].ObservedAt.Equal(observedAt) {
+		t.Errorf("Samples didn't survive the round trip, got %v", samples)
+	}
+	loaded.Walk(func(replayed domain.Publication, samples []domain.ViewSample) {
+		want := publication
+		want.Content = domain.Content{}
+		if !reflect.DeepEqual(replayed, want) {
+			t.Errorf("Expected publication %+v without content to be replayed, got %+v", want, replayed)
+		}
+	})
+}
@@ -2,21 +2,23 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	domain "github.com/alexeyvy/tjlike-agenda/domain"
 	"github.com/alexeyvy/tjlike-agenda/infra/repost"
 	"github.com/alexeyvy/tjlike-agenda/infra/scraping"
 	"github.com/gorilla/mux"
 	log "github.com/sirupsen/logrus"
-	"gopkg.in/yaml.v3"
-	"io/ioutil"
 	"net/http"
+	"os"
+	"sort"
 	"strconv"
 	"sync"
 	"time"
 )
 
 type Scraper interface {
-	ScrapeRecentPublications(domain.Channel) ([]domain.Publication, error)
+	ScrapeRecentPublications(domain.Channel, scraping.Depth) (scraping.Result, error)
 }
 
 type scraperPoolElement struct {
@@ -25,65 +27,56 @@ type scraperPoolElement struct {
 	config     ScraperConfigEntry
 }
 
-type ScraperConfigEntry struct {
-	Parallel                 bool
-	Frequency                int
-	PauseBetweenSyncChannels int `yaml:"pause_between_sync_channels"`
-	Channels                 []string
-}
-type preferences struct {
-	Scrapers struct {
-		Telegram ScraperConfigEntry
+func maxInt(a, b int) int {
+	if a > b {
+		return a
 	}
-}
-
-func initPreferences() preferences {
-	log.Info("Reading YAML configuration at config.yaml")
-
-	yamlFile, err := ioutil.ReadFile("config.yaml")
-	if err != nil {
-		log.Fatalf("YAML config reading error: #%v ", err)
-	}
-	var preferences preferences
-	err = yaml.Unmarshal(yamlFile, &preferences)
-	if err != nil {
-		log.Fatalf("YAML config unmarshal error: %v", err)
-	}
-	return preferences
+	return b
 }
 
 type GlobalSelector interface {
-	SelectPublication(
+	SelectPublications(
 		candidates map[domain.Channel][]domain.Publication,
 		exists func(publication domain.Publication) bool,
-	) (domain.Publication, domain.SuggestionRate, error)
+	) ([]domain.Selection, error)
 }
 type RepostWriterService interface {
-	Repost(domain.Publication, domain.SuggestionRate) (domain.Repost, error)
+	RepostSelection(domain.Selection) (repost.StoredRepost, error)
 	ExistsForPublication(domain.Publication) bool
+	UpdateChannel(domain.ChannelInfo) error
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "backtest" {
+		runBacktest(os.Args[2:])
+		return
+	}
 	preferences := initPreferences()
 
-	store := repost.NewFileStore("tjlike_agenda_db.txt")
-	runApi(store)
+	repostService := repost.NewService(preferences.Storage.initStore(), preferences.Selection.Stories.toStoryRules())
+	runApi(repostService, preferences.Api)
+	runPurging(repostService, preferences.Storage.Retention)
+
+	snapshots := preferences.Snapshots.initStore()
 
 	scraperPool := []scraperPoolElement{
 		{
 			"telegram",
-			&scraping.TelegramScraper{},
+			scraping.NewTelegramScraper(
+				preferences.Scrapers.Telegram.BaseURL,
+				preferences.Scrapers.Telegram.httpClient(),
+				preferences.Scrapers.Telegram.Retry.toRetryPolicy(),
+				preferences.Scrapers.Telegram.rateLimiter(),
+			),
 			preferences.Scrapers.Telegram,
 		},
 	}
 
-	var localSelector domain.LocalSelector
-	localSelector = domain.NewLocalSelector()
-	var selector GlobalSelector
-	selector = domain.NewGlobalSelector(localSelector)
-
 	var repostWriter RepostWriterService
-	repostWriter = repost.NewService(store)
+	repostWriter = repostService
+
+	var selector GlobalSelector
+	selector = preferences.globalSelector(repostService, time.Now)
 
 	for _, scraperPoolEl := range scraperPool {
 		scraperPoolEntry := scraperPoolEl
@@ -94,28 +87,53 @@ func main() {
 					scraperWg sync.WaitGroup
 					msgMutex  sync.Mutex
 				)
+				// bounds the number of channels scraped at once in parallel mode
+				workerSlots := make(chan struct{}, maxInt(scraperPoolEntry.config.Workers, 1))
 				log.Debugf(
 					"Preparing to scrape %d channels for platform %s",
 					len(scraperPoolEntry.config.Channels),
 					scraperPoolEntry.platformId,
 				)
 				for _, src := range scraperPoolEntry.config.Channels {
-					f := func(src string) {
+					f := func(src ChannelConfigEntry) {
 						if scraperPoolEntry.config.Parallel {
-							defer scraperWg.Done()
+							defer func() {
+								<-workerSlots
+								scraperWg.Done()
+							}()
 						}
-						channel := domain.NewChannel(src)
-						publications, err := scraperPoolEntry.s.ScrapeRecentPublications(channel)
+						channel := src.toChannel()
+						result, err := scraperPoolEntry.s.ScrapeRecentPublications(channel, scraperPoolEntry.config.depthFor(src))
 						if err != nil {
-							log.Errorf("scraping failed on channel %s platform %s: %s", channel.Id, scraperPoolEntry.platformId, err.Error())
+							logger := log.WithField("platform", scraperPoolEntry.platformId)
+							var statusErr *scraping.HTTPStatusError
+							if errors.As(err, &statusErr) {
+								logger = logger.WithFields(log.Fields{"status": statusErr.StatusCode, "rate_limited": statusErr.IsRateLimited()})
+							}
+							logger.Errorf("scraping failed on channel %s platform %s: %s", channel.Id, scraperPoolEntry.platformId, err.Error())
 							return
 						}
+						if len(result.ParseErrors) > 0 {
+							log.WithFields(log.Fields{
+								"platform":     scraperPoolEntry.platformId,
+								"parse_errors": len(result.ParseErrors),
+								"parsed":       len(result.Publications),
+							}).Warnf("some publications on channel %s could not be parsed, first one: %s", channel.Id, result.ParseErrors[0])
+							for _, parseError := range result.ParseErrors {
+								log.Debugf("parse error on channel %s: %s", channel.Id, parseError)
+							}
+						}
+						channel.Info = result.Channel
+						if err := repostWriter.UpdateChannel(result.Channel); err != nil {
+							log.Errorf("cannot store info of channel %s: %s", channel.Id, err)
+						}
 						msgMutex.Lock()
-						collectedPublications[channel] = publications
+						collectedPublications[channel] = result.Publications
 						msgMutex.Unlock()
 					}
 					if scraperPoolEntry.config.Parallel {
 						scraperWg.Add(1)
+						workerSlots <- struct{}{}
 						go f(src)
 					} else {
 						f(src)
@@ -126,16 +144,30 @@ func main() {
 
 				log.Debugf("All channels finished for platform %s", scraperPoolEntry.platformId)
 
-				best, suggestionRate, err := selector.SelectPublication(collectedPublications, repostWriter.ExistsForPublication)
+				observedAt := time.Now()
+				for _, publications := range collectedPublications {
+					snapshots.Record(publications, observedAt)
+				}
+				snapshots.ApplyRetention()
+				if err := snapshots.Push(); err != nil {
+					log.Errorf("cannot persist view snapshots: %s", err)
+				}
+
+				selections, err := selector.SelectPublications(collectedPublications, repostWriter.ExistsForPublication)
 				if err == domain.ErrExhausted {
 					log.Infof("No trending publications for platform %s so far", scraperPoolEntry.platformId)
 				}
-				if err == nil {
-					if _, err := repostWriter.Repost(best, suggestionRate); err != nil {
+				for _, selection := range selections {
+					if _, err := repostWriter.RepostSelection(selection); err != nil {
 						log.Errorf("Repost succeeded, however, there was an error when persisting it in the DB: %s", err)
 					}
 
-					log.Infof("Picked most trending publication %s for platform %s", best.Id, scraperPoolEntry.platformId)
+					log.Infof(
+						"Picked trending publication %s with rate %.2f for platform %s",
+						selection.Publication.Id,
+						selection.Rate,
+						scraperPoolEntry.platformId,
+					)
 				}
 				log.Debugf(
 					"Sleeping %d seconds before next traversal for platform %s",
@@ -151,43 +183,245 @@ func main() {
 }
 
 type RepostReaderService interface {
-	PickUpMostTrending(clearUp bool) []domain.Repost
-	PurgeIrrelevant() error
+	PickUp(consumer string, limit int, clearUp bool) ([]repost.StoredRepost, error)
+	ReadAfter(id int, limit int) []repost.StoredRepost
+	Ack(consumer string, id int) error
+	Replay(consumer string, since time.Time) error
+	DeadLetters() []repost.StoredRepost
+	Register(consumer string) error
+	Consumers() map[string]int
+	RemoveConsumer(consumer string) error
+}
+type RepostPurgerService interface {
+	Purge(repost.Retention) (repost.PurgeStats, error)
 }
 type RepostApiMessage struct {
-	PublicationId string `json:"publication-id"`
-	PostedAt      string `json:"posted-at"`
-	RepostedAt    string `json:"reposted-at"`
+	Id            int                   `json:"id"`
+	PublicationId string                `json:"publication-id"`
+	PostedAt      string                `json:"posted-at"`
+	RepostedAt    string                `json:"reposted-at"`
+	Content       ContentApiMessage     `json:"content"`
+	Channel       ChannelApiMessage     `json:"channel"`
+	Explanation   ExplanationApiMessage `json:"explanation"`
 }
 
-func runApi(store repost.Store) {
-	var service RepostReaderService
-	service = repost.NewService(store)
-	r := mux.NewRouter()
-	r.HandleFunc("/reposts", func(response http.ResponseWriter, request *http.Request) {
-		response.WriteHeader(200)
+// ExplanationApiMessage tells editors why the publication was picked
+type ExplanationApiMessage struct {
+	Rate               float64              `json:"rate"`
+	Selector           string               `json:"selector"`
+	Inputs             map[string]float64   `json:"inputs"`
+	Factors            map[string]float64   `json:"factors"`
+	LocalRate          float64              `json:"local-rate"`
+	Threshold          float64              `json:"threshold"`
+	Rules              []RuleApiMessage     `json:"rules"`
+	RatedPublicationId string               `json:"rated-publication-id"`
+	RunnersUp          []RunnerUpApiMessage `json:"runners-up"`
+}
+type RuleApiMessage struct {
+	Name   string  `json:"name"`
+	Action string  `json:"action"`
+	Factor float64 `json:"factor,omitempty"`
+}
+type RunnerUpApiMessage struct {
+	PublicationId string  `json:"publication-id"`
+	ChannelId     string  `json:"channel-id"`
+	Rate          float64 `json:"rate"`
+}
 
-		reposts := service.PickUpMostTrending(true)
-		repostMessages := make([]RepostApiMessage, len(reposts))
-		for k, r := range reposts {
-			repostMessages[k] = RepostApiMessage{
-				string(r.Pub.Id),
-				r.Pub.PostedAt.String(),
-				r.RepostedAt.String(),
-			}
+func newExplanationApiMessage(repost domain.Repost) ExplanationApiMessage {
+	explanation := repost.Explanation
+	message := ExplanationApiMessage{
+		Rate:               float64(repost.Rate),
+		Selector:           explanation.Selector,
+		Inputs:             nonNilFactors(explanation.Inputs),
+		Factors:            nonNilFactors(explanation.Factors),
+		LocalRate:          float64(explanation.LocalRate),
+		Threshold:          float64(explanation.Threshold),
+		Rules:              make([]RuleApiMessage, len(repost.Rules)),
+		RatedPublicationId: string(explanation.RatedPublicationId),
+		RunnersUp:          make([]RunnerUpApiMessage, len(explanation.RunnersUp)),
+	}
+	for k, rule := range repost.Rules {
+		message.Rules[k] = RuleApiMessage{rule.Name, string(rule.Action), rule.Factor}
+	}
+	for k, runnerUp := range explanation.RunnersUp {
+		message.RunnersUp[k] = RunnerUpApiMessage{string(runnerUp.PublicationId), runnerUp.ChannelId, float64(runnerUp.Rate)}
+	}
+	return message
+}
+
+// nonNilFactors makes sure empty factors are serialized as {} rather than null
+func nonNilFactors(factors map[string]float64) map[string]float64 {
+	if factors == nil {
+		return map[string]float64{}
+	}
+	return factors
+}
+
+type ChannelApiMessage struct {
+	Id          string `json:"id"`
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	AvatarURL   string `json:"avatar-url"`
+	Subscribers *int   `json:"subscribers"`
+}
+
+func newChannelApiMessage(info domain.ChannelInfo) ChannelApiMessage {
+	message := ChannelApiMessage{
+		Id:          info.Id,
+		Title:       info.Title,
+		Description: info.Description,
+		AvatarURL:   info.AvatarURL,
+	}
+	if info.SubscribersKnown() {
+		subscribers := info.Subscribers
+		message.Subscribers = &subscribers
+	}
+	return message
+}
+
+type ContentApiMessage struct {
+	Text          string                 `json:"text"`
+	HTML          string                 `json:"html"`
+	Photos        []string               `json:"photos"`
+	Videos        []string               `json:"videos"`
+	Links         []string               `json:"links"`
+	LinkPreview   *LinkPreviewApiMessage `json:"link-preview"`
+	ForwardedFrom string                 `json:"forwarded-from"`
+	ReplyTo       string                 `json:"reply-to"`
+	Hashtags      []string               `json:"hashtags"`
+}
+type LinkPreviewApiMessage struct {
+	URL         string `json:"url"`
+	SiteName    string `json:"site-name"`
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	ImageURL    string `json:"image-url"`
+}
+
+func newContentApiMessage(content domain.Content) ContentApiMessage {
+	message := ContentApiMessage{
+		Text:          content.Text,
+		HTML:          content.HTML,
+		Photos:        nonNilStrings(content.Photos),
+		Videos:        nonNilStrings(content.Videos),
+		Links:         nonNilStrings(content.Links),
+		ForwardedFrom: content.ForwardedFrom,
+		ReplyTo:       string(content.ReplyTo),
+		Hashtags:      nonNilStrings(content.Hashtags),
+	}
+	if content.LinkPreview != nil {
+		message.LinkPreview = &LinkPreviewApiMessage{
+			content.LinkPreview.URL,
+			content.LinkPreview.SiteName,
+			content.LinkPreview.Title,
+			content.LinkPreview.Description,
+			content.LinkPreview.ImageURL,
 		}
-		jsonOutput, _ := json.Marshal(repostMessages)
-		_, err := response.Write(jsonOutput)
+	}
+	return message
+}
 
-		if err != nil {
-			log.Error("Error sending API response")
+// nonNilStrings makes sure empty lists are serialized as [] rather than null
+func nonNilStrings(s []string) []string {
+	if s == nil {
+		return []string{}
+	}
+	return s
+}
+
+// consumerOf tells who reads reposts, each consumer has its own read state
+func consumerOf(request *http.Request) string {
+	if consumer := request.URL.Query().Get("consumer"); consumer != "" {
+		return consumer
+	}
+	return repost.DefaultConsumer
+}
+
+// isClientError responds with 400 to errors caused by the request rather than by the storage
+func isClientError(response http.ResponseWriter, err error) bool {
+	var (
+		unknownConsumer *repost.UnknownConsumer
+		beyondLatest    *repost.AckBeyondLatest
+	)
+	if errors.As(err, &unknownConsumer) || errors.As(err, &beyondLatest) {
+		http.Error(response, err.Error(), http.StatusBadRequest)
+		return true
+	}
+	return false
+}
+
+// nonNegativeParam reads an optional non-negative integer query parameter
+func nonNegativeParam(request *http.Request, name string) (int, bool, error) {
+	raw := request.URL.Query().Get(name)
+	if raw == "" {
+		return 0, false, nil
+	}
+	value, err := strconv.Atoi(raw)
+	if err != nil || value < 0 {
+		return 0, true, fmt.Errorf("%s must be a non-negative integer", name)
+	}
+	return value, true, nil
+}
+
+func writeReposts(response http.ResponseWriter, reposts []repost.StoredRepost) {
+	response.WriteHeader(200)
+	repostMessages := make([]RepostApiMessage, len(reposts))
+	for k, r := range reposts {
+		repostMessages[k] = RepostApiMessage{
+			r.Id,
+			string(r.Pub.Id),
+			r.Pub.PostedAt.String(),
+			r.RepostedAt.String(),
+			newContentApiMessage(r.Pub.Content),
+			newChannelApiMessage(r.Channel),
+			newExplanationApiMessage(r.Repost),
 		}
-		go func() {
-			if err := service.PurgeIrrelevant(); err != nil {
-				log.Errorf("cannot purge irrelevant reposts: %s", err.Error())
+	}
+	jsonOutput, _ := json.Marshal(repostMessages)
+	if _, err := response.Write(jsonOutput); err != nil {
+		log.Error("Error sending API response")
+	}
+}
+
+// runPurging purges stale reposts on the retention schedule, independently of reads
+func runPurging(service RepostPurgerService, config RetentionConfigEntry) {
+	retention := config.toRetention()
+	schedule := config.schedule()
+	if retention.KeepForever {
+		log.Info("Reposts are kept forever, purging is off")
+		return
+	}
+	go func() {
+		for {
+			stats, err := service.Purge(retention)
+			if err != nil {
+				log.Errorf("cannot purge stale reposts: %s", err)
+			} else {
+				log.WithFields(log.Fields{
+					"purged":              stats.Purged,
+					"dead_lettered":       stats.DeadLettered,
+					"kept_unread":         stats.KeptUnread,
+					"dead_letters_purged": stats.DeadLettersPurged,
+				}).Debug("Purged stale reposts")
 			}
-		}()
-	})
+			time.Sleep(schedule)
+		}
+	}()
+}
+
+type ConsumerApiMessage struct {
+	Name           string `json:"name"`
+	AcknowledgedId int    `json:"acknowledged-id"`
+}
+
+func runApi(service RepostReaderService, config ApiConfigEntry) {
+	for _, consumer := range config.Consumers {
+		if err := service.Register(consumer); err != nil {
+			log.Fatalf("cannot register consumer %s: %v", consumer, err)
+		}
+	}
+	r := newApiRouter(service, config)
 	log.Info("Running HTTP API on port 35971")
 
 	go func() {
@@ -197,3 +431,129 @@ func runApi(store repost.Store) {
 		}
 	}()
 }
+
+func newApiRouter(service RepostReaderService, config ApiConfigEntry) *mux.Router {
+	// requestedConsumer resolves the consumer of the request and rejects it unless registered
+	requestedConsumer := func(response http.ResponseWriter, request *http.Request) (string, bool) {
+		consumer := consumerOf(request)
+		if _, registered := service.Consumers()[consumer]; !registered {
+			http.Error(response, (&repost.UnknownConsumer{Consumer: consumer}).Error(), http.StatusBadRequest)
+			return "", false
+		}
+		return consumer, true
+	}
+
+	r := mux.NewRouter()
+	r.HandleFunc("/reposts", func(response http.ResponseWriter, request *http.Request) {
+		after, afterSet, err := nonNegativeParam(request, "after")
+		if err != nil {
+			http.Error(response, err.Error(), http.StatusBadRequest)
+			return
+		}
+		limit, _, err := nonNegativeParam(request, "limit")
+		if err != nil {
+			http.Error(response, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		consumer, accepted := requestedConsumer(response, request)
+		if !accepted {
+			return
+		}
+		if afterSet {
+			writeReposts(response, service.ReadAfter(after, limit))
+			return
+		}
+		// with ack_on_read reading acknowledges, as it used to before explicit acknowledgement
+		reposts, err := service.PickUp(consumer, limit, config.AckOnRead)
+		if isClientError(response, err) {
+			return
+		}
+		if err != nil {
+			log.Errorf("cannot pick up reposts: %s", err)
+			http.Error(response, "cannot pick up reposts", http.StatusInternalServerError)
+			return
+		}
+		writeReposts(response, reposts)
+	}).Methods(http.MethodGet)
+	r.HandleFunc("/reposts/dead-letters", func(response http.ResponseWriter, request *http.Request) {
+		writeReposts(response, service.DeadLetters())
+	}).Methods(http.MethodGet)
+	r.HandleFunc("/reposts/ack", func(response http.ResponseWriter, request *http.Request) {
+		upTo, upToSet, err := nonNegativeParam(request, "up-to")
+		if err != nil || !upToSet {
+			http.Error(response, "up-to must be ID of the last delivered repost", http.StatusBadRequest)
+			return
+		}
+		consumer, accepted := requestedConsumer(response, request)
+		if !accepted {
+			return
+		}
+		err = service.Ack(consumer, upTo)
+		if isClientError(response, err) {
+			return
+		}
+		if err != nil {
+			log.Errorf("cannot acknowledge reposts: %s", err)
+			http.Error(response, "cannot acknowledge reposts", http.StatusInternalServerError)
+			return
+		}
+		response.WriteHeader(http.StatusNoContent)
+	}).Methods(http.MethodPost)
+	r.HandleFunc("/reposts/replay", func(response http.ResponseWriter, request *http.Request) {
+		since, err := time.Parse(time.RFC3339, request.URL.Query().Get("since"))
+		if err != nil {
+			http.Error(response, "since must be an RFC 3339 moment", http.StatusBadRequest)
+			return
+		}
+		consumer, accepted := requestedConsumer(response, request)
+		if !accepted {
+			return
+		}
+		err = service.Replay(consumer, since)
+		if isClientError(response, err) {
+			return
+		}
+		if err != nil {
+			log.Errorf("cannot replay reposts: %s", err)
+			http.Error(response, "cannot replay reposts", http.StatusInternalServerError)
+			return
+		}
+		response.WriteHeader(http.StatusNoContent)
+	}).Methods(http.MethodPost)
+	r.HandleFunc("/consumers", func(response http.ResponseWriter, request *http.Request) {
+		consumers := service.Consumers()
+		consumerMessages := make([]ConsumerApiMessage, 0, len(consumers))
+		for name, acknowledgedId := range consumers {
+			consumerMessages = append(consumerMessages, ConsumerApiMessage{name, acknowledgedId})
+		}
+		sort.Slice(consumerMessages, func(i, j int) bool { return consumerMessages[i].Name < consumerMessages[j].Name })
+		jsonOutput, _ := json.Marshal(consumerMessages)
+		response.WriteHeader(200)
+		if _, err := response.Write(jsonOutput); err != nil {
+			log.Error("Error sending API response")
+		}
+	}).Methods(http.MethodGet)
+	r.HandleFunc("/consumers", func(response http.ResponseWriter, request *http.Request) {
+		consumer := request.URL.Query().Get("consumer")
+		if consumer == "" {
+			http.Error(response, "consumer must be named", http.StatusBadRequest)
+			return
+		}
+		if err := service.Register(consumer); err != nil {
+			log.Errorf("cannot register consumer: %s", err)
+			http.Error(response, "cannot register consumer", http.StatusInternalServerError)
+			return
+		}
+		response.WriteHeader(http.StatusNoContent)
+	}).Methods(http.MethodPost)
+	r.HandleFunc("/consumers/{consumer}", func(response http.ResponseWriter, request *http.Request) {
+		if err := service.RemoveConsumer(mux.Vars(request)["consumer"]); err != nil {
+			log.Errorf("cannot remove consumer: %s", err)
+			http.Error(response, "cannot remove consumer", http.StatusInternalServerError)
+			return
+		}
+		response.WriteHeader(http.StatusNoContent)
+	}).Methods(http.MethodDelete)
+	return r
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/alexeyvy/tjlike-agenda/domain"
+	"github.com/alexeyvy/tjlike-agenda/infra/repost"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// newApiFixture serves the API over a service with the given number of reposts, only the default consumer is registered
+func newApiFixture(t *testing.T, reposts int, config ApiConfigEntry) http.Handler {
+	service := repost.NewService(repost.NewInMemoryStore(), domain.StoryRules{})
+	if err := service.Register(repost.DefaultConsumer); err != nil {
+		t.Fatalf("Register() threw an error: %v", err)
+	}
+	postedAt := time.Unix(1661773286, 0)
+	for k := 1; k <= reposts; k++ {
+		publication := domain.NewPublication("platform/"+strconv.Itoa(k), 10300, postedAt)
+		if _, err := service.RepostSelection(domain.Selection{Publication: publication, Rate: domain.SuggestionRate(5)}); err != nil {
+			t.Fatalf("RepostSelection() threw an error: %v", err)
+		}
+	}
+	return newApiRouter(service, config)
+}
+
+func serve(handler http.Handler, method string, target string) *httptest.ResponseRecorder {
+	response := httptest.NewRecorder()
+	handler.ServeHTTP(response, httptest.NewRequest(method, target, nil))
+	return response
+}
+
+// repostIds serves GET request and tells IDs of returned reposts
+func repostIds(t *testing.T, handler http.Handler, target string) []int {
+	response := serve(handler, http.MethodGet, target)
+	if response.Code != http.StatusOK {
+		t.Fatalf("Expected %s to respond with 200, got %d: %s", target, response.Code, response.Body)
+	}
+	var messages []RepostApiMessage
+	if err := json.Unmarshal(response.Body.Bytes(), &messages); err != nil {
+		t.Fatalf("Cannot decode reposts returned by %s: %v", target, err)
+	}
+	ids := make([]int, len(messages))
+	for k, message := range messages {
+		ids[k] = message.Id
+	}
+	return ids
+}
+
+func TestApiPagesThroughReposts(t *testing.T) {
+	t.Parallel()
+	api := newApiFixture(t, 5, ApiConfigEntry{})
+
+	type table struct {
+		target   string
+		expected []int
+	}
+	for _, expectation := range []table{
+		{"/reposts?after=0", []int{1, 2, 3, 4, 5}},
+		{"/reposts?after=2&limit=2", []int{3, 4}},
+		{"/reposts?after=5", []int{}},
+		{"/reposts?limit=3", []int{1, 2, 3}},
+		{"/reposts?limit=0", []int{1, 2, 3, 4, 5}},
+	} {
+		ids := repostIds(t, api, expectation.target)
+		if len(ids) != len(expectation.expected) {
+			t.Errorf("Expected %s to return %v, got %v", expectation.target, expectation.expected, ids)
+			continue
+		}
+		for k := range ids {
+			if ids[k] != expectation.expected[k] {
+				t.Errorf("Expected %s to return %v, got %v", expectation.target, expectation.expected, ids)
+				break
+			}
+		}
+	}
+
+	for _, target := range []string{
+		"/reposts?after=-1",
+		"/reposts?after=first",
+		"/reposts?limit=-5",
+		"/reposts?limit=ten",
+		"/reposts?consumer=bot",
+		"/reposts?consumer=bot&after=0",
+	} {
+		if response := serve(api, http.MethodGet, target); response.Code != http.StatusBadRequest {
+			t.Errorf("Expected %s to respond with 400, got %d", target, response.Code)
+		}
+	}
+}
+
+func TestApiAcknowledgement(t *testing.T) {
+	t.Parallel()
+	api := newApiFixture(t, 3, ApiConfigEntry{})
+
+	for _, target := range []string{
+		"/reposts/ack",
+		"/reposts/ack?up-to=last",
+		"/reposts/ack?up-to=4",
+		"/reposts/ack?up-to=1&consumer=bot",
+	} {
+		if response := serve(api, http.MethodPost, target); response.Code != http.StatusBadRequest {
+			t.Errorf("Expected %s to respond with 400, got %d", target, response.Code)
+		}
+	}
+	if ids := repostIds(t, api, "/reposts"); len(ids) != 3 {
+		t.Errorf("Expected rejected acknowledgements to change nothing, got %v", ids)
+	}
+
+	if response := serve(api, http.MethodPost, "/reposts/ack?up-to=2"); response.Code != http.StatusNoContent {
+		t.Errorf("Expected acknowledgement to respond with 204, got %d", response.Code)
+	}
+	if ids := repostIds(t, api, "/reposts"); len(ids) != 1 || ids[0] != 3 {
+		t.Errorf("Expected only the unacknowledged repost 3 to be returned, got %v", ids)
+	}
+	// reading without acknowledging never changes the read state
+	if ids := repostIds(t, api, "/reposts"); len(ids) != 1 {
+		t.Errorf("Expected the unacknowledged repost to be returned once again, got %v", ids)
+	}
+
+	if response := serve(api, http.MethodPost, "/consumers?consumer=bot"); response.Code != http.StatusNoContent {
+		t.Errorf("Expected registration to respond with 204, got %d", response.Code)
+	}
+	if ids := repostIds(t, api, "/reposts?consumer=bot"); len(ids) != 3 {
+		t.Errorf("Expected registered bot to read all reposts, got %v", ids)
+	}
+}
+
+func TestApiAckOnRead(t *testing.T) {
+	t.Parallel()
+	api := newApiFixture(t, 3, ApiConfigEntry{AckOnRead: true})
+
+	if ids := repostIds(t, api, "/reposts?limit=2"); len(ids) != 2 {
+		t.Errorf("Expected 2 reposts to be picked up, got %v", ids)
+	}
+	if ids := repostIds(t, api, "/reposts"); len(ids) != 1 || ids[0] != 3 {
+		t.Errorf("Expected picked up reposts to be acknowledged, got %v", ids)
+	}
+	if ids := repostIds(t, api, "/reposts"); len(ids) != 0 {
+		t.Errorf("Expected nothing left to pick up, got %v", ids)
+	}
+	// paging never acknowledges anything
+	if ids := repostIds(t, api, "/reposts?after=0"); len(ids) != 3 {
+		t.Errorf("Expected all reposts to be paged through, got %v", ids)
+	}
+}